@@ -0,0 +1,382 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+
+	"github.com/lokidb/engine/v2/encryption"
+	filestore "github.com/lokidb/engine/v2/file_storage"
+)
+
+// The batch log holds the batch that is being written, a batch is applied to the files only after
+// it is synced to the log and the log is emptied once all the files synced it, so a batch found
+// in the log on open is applied again and an incomplete batch is discarded.
+//
+//	magic (4 bytes) | version (2 bytes) | flags (2 bytes)
+//	ops count (uvarint) | ops: delete (1 byte) | key lenght (uvarint) | key | value lenght (uvarint) | value
+//	checksum of everything before (4 bytes)
+//
+// When the store is encrypted the ops are encrypted as a single block.
+const batchLogFilename = "batch_log"
+const batchLogMagic = "LOKB"
+const batchLogVersion = 1
+const batchLogHeaderLenght = 8
+const batchLogEncryptedFlag = 1
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var errIncompleteBatch = errors.New("incomplete batch")
+var errInvalidBatch = fmt.Errorf("%w: invalid batch log", ErrCorrupted)
+
+// Set and delete writes of many keys that are written atomically by Write,
+// the writes of a key are applied in the order they were added
+type WriteBatch struct {
+	ops []filestore.BatchOp
+}
+
+func NewWriteBatch() *WriteBatch {
+	return new(WriteBatch)
+}
+
+func (b *WriteBatch) Set(key string, value []byte) {
+	b.ops = append(b.ops, filestore.BatchOp{Key: key, Value: value})
+}
+
+func (b *WriteBatch) Del(key string) {
+	b.ops = append(b.ops, filestore.BatchOp{Key: key, Delete: true})
+}
+
+// Number of writes in the batch
+func (b *WriteBatch) Len() int {
+	return len(b.ops)
+}
+
+func (b *WriteBatch) Reset() {
+	b.ops = nil
+}
+
+// Write all the writes of the batch, after a crash either all of them or none of them are stored.
+// Deletes of keys that don't exist are ignored. Other writes wait for the batch to finish,
+// a batch that fails to apply is applied again before the next write.
+func (s *storage) Write(batch *WriteBatch) error {
+	if s.isClosed() {
+		return ErrClosed
+	}
+
+	if s.options.readOnly {
+		return ErrReadOnly
+	}
+
+	if batch.Len() == 0 {
+		return nil
+	}
+
+	s.batchLock.Lock()
+	defer s.batchLock.Unlock()
+
+	return s.writeBatch(batch.ops)
+}
+
+// Write the batch through the batch log, called with the batch lock held
+func (s *storage) writeBatch(ops []filestore.BatchOp) error {
+	// Batch left by a failed write is completed before it is overwritten
+	if err := s.recoverBatch(); err != nil {
+		return err
+	}
+	s.batchPending = false
+
+	shards := s.splitBatch(ops)
+	for fileStore, ops := range shards {
+		if err := fileStore.CheckBatch(ops); err != nil {
+			return err
+		}
+	}
+
+	for _, op := range ops {
+		command := "SET"
+		if op.Delete {
+			command = "DEL"
+		}
+
+		if err := s.appendToLog(command, op.Key, op.Value); err != nil {
+			return err
+		}
+	}
+
+	content, err := encodeBatch(ops, s.options.keyProvider)
+	if err != nil {
+		return err
+	}
+
+	// Until the batch is fully applied other writes wait for it to be applied again,
+	// so the batch in the log is never applied over later writes
+	s.batchPending = true
+	if err = writeSynced(s.batchLogPath, content); err != nil {
+		return err
+	}
+
+	defer func() {
+		for _, op := range ops {
+			s.lruCache.Del(op.Key)
+		}
+	}()
+
+	if err = s.applyBatch(shards); err != nil {
+		return err
+	}
+	s.batchPending = false
+
+	return nil
+}
+
+// Take the batch lock for reading for a write that is not a batch, a batch that failed
+// to apply is applied first and the write fails while it can't be applied
+func (s *storage) lockWrites() error {
+	for {
+		s.batchLock.RLock()
+		if !s.batchPending {
+			return nil
+		}
+		s.batchLock.RUnlock()
+
+		s.batchLock.Lock()
+		err := s.recoverPendingBatch()
+		s.batchLock.Unlock()
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Apply the batch that failed to apply, called with the batch lock held for writing
+func (s *storage) recoverPendingBatch() error {
+	if !s.batchPending {
+		return nil
+	}
+
+	if err := s.recoverBatch(); err != nil {
+		return err
+	}
+	s.batchPending = false
+
+	return nil
+}
+
+// Group the writes of the batch by the file that owns the key
+func (s *storage) splitBatch(ops []filestore.BatchOp) map[*filestore.FileKeyValueStore][]filestore.BatchOp {
+	shards := make(map[*filestore.FileKeyValueStore][]filestore.BatchOp)
+
+	for _, op := range ops {
+		fileStore := s.fileStores[s.filesRing.GetMemberForKey(op.Key)]
+		shards[fileStore] = append(shards[fileStore], op)
+	}
+
+	return shards
+}
+
+// Apply the batch to all the files and empty the batch log once the files synced it,
+// the log is kept when any file fails so the batch is applied again before the next write.
+// Files that already applied the batch are skipped when it is applied again.
+func (s *storage) applyBatch(shards map[*filestore.FileKeyValueStore][]filestore.BatchOp) error {
+	for fileStore, ops := range shards {
+		if s.batchApplied[fileStore] {
+			continue
+		}
+
+		if err := fileStore.ApplyBatch(ops); err != nil {
+			return err
+		}
+
+		if s.batchApplied == nil {
+			s.batchApplied = make(map[*filestore.FileKeyValueStore]bool)
+		}
+		s.batchApplied[fileStore] = true
+	}
+
+	if err := writeSynced(s.batchLogPath, nil); err != nil {
+		return err
+	}
+	s.batchApplied = nil
+
+	return nil
+}
+
+// Apply the batch found in the batch log, incomplete batches are discarded.
+// A missing log is created so later batches never depend on creating it.
+func (s *storage) recoverBatch() error {
+	content, err := os.ReadFile(s.batchLogPath)
+	if os.IsNotExist(err) {
+		if err = writeSynced(s.batchLogPath, nil); err != nil {
+			return err
+		}
+
+		return syncDir(filepath.Dir(s.batchLogPath))
+	}
+
+	if err == nil && len(content) == 0 {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	ops, err := decodeBatch(content, s.options.keyProvider)
+	if err == errIncompleteBatch {
+		s.batchApplied = nil
+		return writeSynced(s.batchLogPath, nil)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	for _, op := range ops {
+		s.lruCache.Del(op.Key)
+	}
+
+	return s.applyBatch(s.splitBatch(ops))
+}
+
+func encodeBatch(ops []filestore.BatchOp, provider encryption.KeyProvider) ([]byte, error) {
+	header := make([]byte, batchLogHeaderLenght)
+	copy(header, batchLogMagic)
+	binary.LittleEndian.PutUint16(header[4:6], batchLogVersion)
+
+	var body bytes.Buffer
+	varint := make([]byte, binary.MaxVarintLen64)
+	writeUvarint := func(v uint64) {
+		n := binary.PutUvarint(varint, v)
+		body.Write(varint[:n])
+	}
+
+	writeUvarint(uint64(len(ops)))
+	for _, op := range ops {
+		if op.Delete {
+			body.WriteByte(1)
+		} else {
+			body.WriteByte(0)
+		}
+
+		writeUvarint(uint64(len(op.Key)))
+		body.WriteString(op.Key)
+		writeUvarint(uint64(len(op.Value)))
+		body.Write(op.Value)
+	}
+
+	content := body.Bytes()
+	if provider != nil {
+		binary.LittleEndian.PutUint16(header[6:8], batchLogEncryptedFlag)
+
+		var err error
+		content, err = encryption.Seal(provider, content, header)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	record := append(header, content...)
+	checksum := make([]byte, 4)
+	binary.LittleEndian.PutUint32(checksum, crc32.Checksum(record, crcTable))
+
+	return append(record, checksum...), nil
+}
+
+// Decode the batch log, returns errIncompleteBatch when the batch was not fully written
+func decodeBatch(content []byte, provider encryption.KeyProvider) ([]filestore.BatchOp, error) {
+	if len(content) < batchLogHeaderLenght+4 || string(content[:len(batchLogMagic)]) != batchLogMagic {
+		return nil, errIncompleteBatch
+	}
+
+	record, checksum := content[:len(content)-4], content[len(content)-4:]
+	if crc32.Checksum(record, crcTable) != binary.LittleEndian.Uint32(checksum) {
+		return nil, errIncompleteBatch
+	}
+
+	header, body := record[:batchLogHeaderLenght], record[batchLogHeaderLenght:]
+	if binary.LittleEndian.Uint16(header[4:6]) != batchLogVersion {
+		return nil, fmt.Errorf("unsupported batch log version %d", binary.LittleEndian.Uint16(header[4:6]))
+	}
+
+	if binary.LittleEndian.Uint16(header[6:8])&batchLogEncryptedFlag != 0 {
+		if provider == nil {
+			return nil, filestore.ErrMissingKeyProvider
+		}
+
+		var err error
+		if body, err = encryption.Open(provider, body, header); err != nil {
+			return nil, err
+		}
+	}
+
+	reader := bytes.NewReader(body)
+	readBytes := func() ([]byte, error) {
+		lenght, err := binary.ReadUvarint(reader)
+		if err != nil || lenght > uint64(reader.Len()) {
+			return nil, errInvalidBatch
+		}
+
+		b := make([]byte, lenght)
+		reader.Read(b)
+
+		return b, nil
+	}
+
+	count, err := binary.ReadUvarint(reader)
+	if err != nil || count > uint64(reader.Len()) {
+		return nil, errInvalidBatch
+	}
+
+	ops := make([]filestore.BatchOp, 0, count)
+	for i := uint64(0); i < count; i++ {
+		kind, err := reader.ReadByte()
+		if err != nil {
+			return nil, errInvalidBatch
+		}
+
+		key, err := readBytes()
+		if err != nil {
+			return nil, err
+		}
+
+		value, err := readBytes()
+		if err != nil {
+			return nil, err
+		}
+
+		ops = append(ops, filestore.BatchOp{Key: string(key), Value: value, Delete: kind == 1})
+	}
+
+	return ops, nil
+}
+
+// Replace the content of the file and sync it
+func writeSynced(path string, content []byte) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err = file.Write(content); err != nil {
+		return err
+	}
+
+	return file.Sync()
+}
+
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	return dir.Sync()
+}
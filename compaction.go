@@ -0,0 +1,120 @@
+package engine
+
+import (
+	"context"
+	"log"
+	"sync"
+
+	filestore "github.com/lokidb/engine/v2/file_storage"
+)
+
+// Schedule compactions of the file stores with limited concurrency,
+// all running compactions are canceled on close
+type compactor struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	slots   chan struct{}
+	pending map[*filestore.FileKeyValueStore]bool
+	lock    sync.Mutex
+	wg      sync.WaitGroup
+}
+
+func newCompactor(maxConcurrency int) *compactor {
+	if maxConcurrency < 1 {
+		maxConcurrency = 1
+	}
+
+	c := new(compactor)
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	c.slots = make(chan struct{}, maxConcurrency)
+	c.pending = make(map[*filestore.FileKeyValueStore]bool)
+
+	return c
+}
+
+// Schedule background compaction of the file store, ignored when it's already scheduled
+func (c *compactor) schedule(fs *filestore.FileKeyValueStore) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.pending[fs] || c.ctx.Err() != nil {
+		return
+	}
+
+	c.pending[fs] = true
+	c.wg.Add(1)
+
+	go func() {
+		defer c.wg.Done()
+
+		err := c.run(c.ctx, fs)
+		if err != nil && err != context.Canceled {
+			log.Printf("engine: background compaction failed: %v", err)
+		}
+
+		c.lock.Lock()
+		delete(c.pending, fs)
+		c.lock.Unlock()
+	}()
+}
+
+// Compact all the file stores with deleted items and wait for them to finish
+func (c *compactor) compactAll(ctx context.Context, fileStores map[string]*filestore.FileKeyValueStore) error {
+	var wg sync.WaitGroup
+	errs := make(chan error, len(fileStores))
+
+	for _, fs := range fileStores {
+		wg.Add(1)
+
+		go func(fs *filestore.FileKeyValueStore) {
+			defer wg.Done()
+			errs <- c.run(ctx, fs)
+		}(fs)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Compact the file store once a slot is available, canceled by ctx or by closing the compactor
+func (c *compactor) run(ctx context.Context, fs *filestore.FileKeyValueStore) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stop := make(chan struct{})
+	defer close(stop)
+
+	go func() {
+		select {
+		case <-c.ctx.Done():
+			cancel()
+		case <-stop:
+		}
+	}()
+
+	select {
+	case c.slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-c.slots }()
+
+	return fs.Compact(ctx)
+}
+
+// Cancel running compactions and wait for them to stop
+func (c *compactor) close() {
+	c.lock.Lock()
+	c.cancel()
+	c.lock.Unlock()
+
+	c.wg.Wait()
+}
@@ -2,25 +2,31 @@
 package cursor
 
 import (
+	"errors"
 	"fmt"
 	"io"
-	"os"
 )
 
+var ErrOutOfBound = errors.New("cursor out of bound")
+
 type cursor struct {
-	file      *os.File
+	file      io.ReaderAt
 	start_pos int64
 	end_pos   int64
 	curr_pos  int64
 	length    int64
 }
 
+// Reader of the section of a file, positions are relative to the start of the section
+// and reads never go beyond the end of the section
 type Cursor interface {
-	Seek(int64, int) (int64, error)
-	Read(int) ([]byte, error)
+	io.Reader
+	io.Seeker
+	io.ReaderAt
 }
 
-func New(file *os.File, start int64, length int64) Cursor {
+// Create cursor over the section [start, start+length) of file
+func New(file io.ReaderAt, start int64, length int64) Cursor {
 	c := new(cursor)
 	c.file = file
 	c.start_pos = start
@@ -44,29 +50,83 @@ func (c *cursor) Seek(offset int64, whence int) (int64, error) {
 	}
 
 	if offset > c.end_pos || offset < c.start_pos {
-		return 0, fmt.Errorf("seek out of bound")
+		return 0, fmt.Errorf("seek: %w", ErrOutOfBound)
 	}
 
-	curr, err := c.file.Seek(offset, 0)
-	if err != nil {
-		return 0, err
-	}
+	c.curr_pos = offset
+
+	return c.curr_pos - c.start_pos, nil
+}
 
-	c.curr_pos = curr
+func (c *cursor) Read(p []byte) (int, error) {
+	n, err := c.ReadAt(p, c.curr_pos-c.start_pos)
+	c.curr_pos += int64(n)
 
-	return curr, nil
+	return n, err
 }
 
-func (c *cursor) Read(offset int) ([]byte, error) {
-	if c.curr_pos+int64(offset) > c.end_pos {
-		return nil, fmt.Errorf("read out of bound")
+// Read from offset relative to the start of the cursor, returns io.EOF when
+// the read reached the end of the cursor
+func (c *cursor) ReadAt(p []byte, offset int64) (int, error) {
+	if offset < 0 {
+		return 0, fmt.Errorf("read: %w", ErrOutOfBound)
+	}
+
+	if offset >= c.length {
+		return 0, io.EOF
 	}
 
-	data := make([]byte, offset)
-	_, err := c.file.Read(data)
-	if err != nil {
-		return nil, err
+	// Reads are cut at the end of the cursor
+	cut := false
+	if remaining := c.length - offset; int64(len(p)) > remaining {
+		p = p[:remaining]
+		cut = true
+	}
+
+	n, err := c.file.ReadAt(p, c.start_pos+offset)
+	if err == nil && cut {
+		err = io.EOF
+	}
+
+	return n, err
+}
+
+type writeCursor struct {
+	*cursor
+	writer io.WriterAt
+}
+
+// Cursor that can also change the bytes of its section, writes that don't fit in the section are rejected
+type WriteCursor interface {
+	Cursor
+	io.Writer
+	io.WriterAt
+}
+
+// Create writable cursor over the section [start, start+length) of file
+func NewWritable(file interface {
+	io.ReaderAt
+	io.WriterAt
+}, start int64, length int64) WriteCursor {
+	c := new(writeCursor)
+	c.cursor = New(file, start, length).(*cursor)
+	c.writer = file
+
+	return c
+}
+
+func (c *writeCursor) Write(p []byte) (int, error) {
+	n, err := c.WriteAt(p, c.curr_pos-c.start_pos)
+	c.curr_pos += int64(n)
+
+	return n, err
+}
+
+// Write at offset relative to the start of the cursor, the whole write must fit in the cursor
+func (c *writeCursor) WriteAt(p []byte, offset int64) (int, error) {
+	if offset < 0 || offset+int64(len(p)) > c.length {
+		return 0, fmt.Errorf("write: %w", ErrOutOfBound)
 	}
 
-	return data, nil
+	return c.writer.WriteAt(p, c.start_pos+offset)
 }
@@ -1,6 +1,7 @@
 package cursor
 
 import (
+	"errors"
 	"io"
 	"os"
 	"testing"
@@ -15,14 +16,20 @@ func TestPermissions(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer file.Close()
 
 	file.WriteString("123456789qwertyuiopasdfghjklzxcvbnm")
 
 	c := New(file, 5, 5)
 
-	_, err = c.Read(6)
-	if err == nil {
-		t.Error("expecting error when accessing out of range bytes")
+	content := make([]byte, 6)
+	n, err := c.Read(content)
+	if n != 5 || string(content[:n]) != "6789q" {
+		t.Errorf("expecting read to be limited to the cursor, got %q", content[:n])
+	}
+
+	if _, err = c.Read(content); err != io.EOF {
+		t.Errorf("expecting io.EOF at the end of the cursor not %v", err)
 	}
 
 	pos, err := c.Seek(0, io.SeekEnd)
@@ -30,50 +37,99 @@ func TestPermissions(t *testing.T) {
 		t.Error("expecting to be able to seek to the end of the cursor")
 	}
 
-	if pos != 10 {
-		t.Errorf("expecting end of cursor to be 10 not %d", pos)
+	if pos != 5 {
+		t.Errorf("expecting end of cursor to be 5 not %d", pos)
 	}
 
 	_, err = c.Seek(5, io.SeekEnd)
-	if err == nil {
+	if !errors.Is(err, ErrOutOfBound) {
 		t.Error("expecting to 'seek out of bound' error")
 	}
 
 	_, err = c.Seek(-20, io.SeekCurrent)
-	if err == nil {
+	if !errors.Is(err, ErrOutOfBound) {
 		t.Error("expecting to 'seek out of bound' error")
 	}
 
 	_, err = c.Seek(50, io.SeekCurrent)
-	if err == nil {
+	if !errors.Is(err, ErrOutOfBound) {
 		t.Error("expecting to 'seek out of bound' error")
 	}
 
 	_, err = c.Seek(-1, io.SeekStart)
-	if err == nil {
+	if !errors.Is(err, ErrOutOfBound) {
 		t.Error("expecting to 'seek out of bound' error")
 	}
 
 	_, err = c.Seek(10, io.SeekStart)
-	if err == nil {
+	if !errors.Is(err, ErrOutOfBound) {
 		t.Error("expecting to 'seek out of bound' error")
 	}
 
-	pos, err = c.Seek(0, io.SeekStart)
+	pos, err = c.Seek(1, io.SeekStart)
 	if err != nil {
 		t.Error("expecting seek to work")
 	}
 
-	if pos != 5 {
-		t.Errorf("expecting position after seek to be 5 not %d", pos)
+	if pos != 1 {
+		t.Errorf("expecting position after seek to be 1 not %d", pos)
+	}
+
+	content, err = io.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	content, err := c.Read(1)
+	if string(content) != "789q" {
+		t.Errorf("expecting rest of cursor to be '789q' not %q", content)
+	}
+
+	part := make([]byte, 3)
+	if n, err = c.ReadAt(part, 3); n != 2 || err != io.EOF || string(part[:n]) != "9q" {
+		t.Errorf("expecting ReadAt to stop at the end of the cursor, got %q %v", part[:n], err)
+	}
+
+	if _, err = c.ReadAt(part, -1); !errors.Is(err, ErrOutOfBound) {
+		t.Error("expecting 'read out of bound' error")
+	}
+}
+
+func TestWritable(t *testing.T) {
+	t.Cleanup(func() {
+		os.Remove("test_cursor_write.tst")
+	})
+
+	file, err := os.Create("test_cursor_write.tst")
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer file.Close()
+
+	file.WriteString("0123456789")
+
+	c := NewWritable(file, 2, 5)
+
+	if _, err = c.WriteAt([]byte("abc"), 3); !errors.Is(err, ErrOutOfBound) {
+		t.Error("expecting 'write out of bound' error")
+	}
+
+	c.Seek(1, io.SeekStart)
+	if n, err := c.Write([]byte("ab")); n != 2 || err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := c.WriteAt([]byte("x"), 4); n != 1 || err != nil {
+		t.Fatal(err)
+	}
+
+	content, _ := os.ReadFile("test_cursor_write.tst")
+	if string(content) != "012ab5x789" {
+		t.Errorf("expecting writes inside the cursor only, got %s", content)
+	}
 
-	if content[0] != '6' {
-		t.Error("expecting first byte of cursor to be '6'")
+	// Reads continue after the written bytes
+	rest, _ := io.ReadAll(c)
+	if string(rest) != "5x" {
+		t.Errorf("expecting to read '5x' after the write not %s", rest)
 	}
 }
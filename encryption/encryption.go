@@ -0,0 +1,167 @@
+// AES-GCM encryption of data with keys from a rotating key provider
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Sealed data layout:
+//
+//	key id (4 bytes) | nonce (12 bytes) | ciphertext and tag
+const keyIDLenght = 4
+const nonceLenght = 12
+const tagLenght = 16
+
+// Size added to the data by Seal
+const Overhead = keyIDLenght + nonceLenght + tagLenght
+
+var ErrUnknownKey = errors.New("unknown encryption key")
+var ErrDecryption = errors.New("decryption failed")
+
+// Provide the encryption keys, keys must be 16, 24 or 32 bytes long (AES-128, AES-192 or AES-256).
+// Data is always encrypted with the current key, older keys must stay available
+// for decrypting data until it is rewritten with the current key.
+type KeyProvider interface {
+	CurrentKey() (id uint32, key []byte, err error)
+	Key(id uint32) ([]byte, error)
+}
+
+// Thread-safe in-memory KeyProvider that supports key rotation
+type KeyRing struct {
+	keys    map[uint32][]byte
+	current uint32
+	lock    sync.RWMutex
+}
+
+func NewKeyRing(id uint32, key []byte) (*KeyRing, error) {
+	kr := &KeyRing{keys: make(map[uint32][]byte)}
+
+	if err := kr.Rotate(id, key); err != nil {
+		return nil, err
+	}
+
+	return kr, nil
+}
+
+// Add new key and use it as the current key, the previous keys are kept for decryption
+func (kr *KeyRing) Rotate(id uint32, key []byte) error {
+	if err := validateKey(key); err != nil {
+		return err
+	}
+
+	kr.lock.Lock()
+	defer kr.lock.Unlock()
+
+	if existing, exists := kr.keys[id]; exists && string(existing) != string(key) {
+		return fmt.Errorf("key id %d is already used by another key", id)
+	}
+
+	kr.keys[id] = append([]byte(nil), key...)
+	kr.current = id
+
+	return nil
+}
+
+func (kr *KeyRing) CurrentKey() (uint32, []byte, error) {
+	kr.lock.RLock()
+	defer kr.lock.RUnlock()
+
+	return kr.current, kr.keys[kr.current], nil
+}
+
+func (kr *KeyRing) Key(id uint32) ([]byte, error) {
+	kr.lock.RLock()
+	defer kr.lock.RUnlock()
+
+	key, exists := kr.keys[id]
+	if !exists {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownKey, id)
+	}
+
+	return key, nil
+}
+
+// Encrypt and authenticate plaintext and authenticate additionalData with the current key
+func Seal(provider KeyProvider, plaintext []byte, additionalData []byte) ([]byte, error) {
+	id, key, err := provider.CurrentKey()
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed := make([]byte, keyIDLenght+nonceLenght, Overhead+len(plaintext))
+	binary.LittleEndian.PutUint32(sealed, id)
+
+	nonce := sealed[keyIDLenght:]
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(sealed, nonce, plaintext, additionalData), nil
+}
+
+// Decrypt data returned by Seal with the key it was encrypted with
+func Open(provider KeyProvider, sealed []byte, additionalData []byte) ([]byte, error) {
+	id, err := KeyID(sealed)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := provider.Key(id)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := aead.Open(nil, sealed[keyIDLenght:keyIDLenght+nonceLenght], sealed[keyIDLenght+nonceLenght:], additionalData)
+	if err != nil {
+		return nil, ErrDecryption
+	}
+
+	return plaintext, nil
+}
+
+// Id of the key that sealed the data
+func KeyID(sealed []byte) (uint32, error) {
+	if len(sealed) < Overhead {
+		return 0, ErrDecryption
+	}
+
+	return binary.LittleEndian.Uint32(sealed), nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if err := validateKey(key); err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func validateKey(key []byte) error {
+	switch len(key) {
+	case 16, 24, 32:
+		return nil
+	default:
+		return fmt.Errorf("invalid encryption key lenght %d, must be 16, 24 or 32 bytes", len(key))
+	}
+}
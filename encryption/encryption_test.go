@@ -0,0 +1,77 @@
+package encryption
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestSealOpen(t *testing.T) {
+	keyRing, err := NewKeyRing(1, bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealed, err := Seal(keyRing, []byte("secret"), []byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Contains(sealed, []byte("secret")) || len(sealed) != len("secret")+Overhead {
+		t.Error("expecting sealed data to not contain the plaintext")
+	}
+
+	plaintext, err := Open(keyRing, sealed, []byte("key"))
+	if err != nil || string(plaintext) != "secret" {
+		t.Errorf("expecting to open sealed data, got %s %v", plaintext, err)
+	}
+
+	_, err = Open(keyRing, sealed, []byte("other key"))
+	if !errors.Is(err, ErrDecryption) {
+		t.Error("expecting open to fail with different additional data")
+	}
+
+	sealed[len(sealed)-1] ^= 1
+	_, err = Open(keyRing, sealed, []byte("key"))
+	if !errors.Is(err, ErrDecryption) {
+		t.Error("expecting open to fail for modified data")
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	keyRing, err := NewKeyRing(1, bytes.Repeat([]byte{1}, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldSealed, _ := Seal(keyRing, []byte("old"), nil)
+
+	if err = keyRing.Rotate(2, bytes.Repeat([]byte{2}, 16)); err != nil {
+		t.Fatal(err)
+	}
+
+	newSealed, _ := Seal(keyRing, []byte("new"), nil)
+
+	if id, _ := KeyID(newSealed); id != 2 {
+		t.Errorf("expecting new data to be sealed with the current key not %d", id)
+	}
+
+	plaintext, err := Open(keyRing, oldSealed, nil)
+	if err != nil || string(plaintext) != "old" {
+		t.Error("expecting old data to be opened with the previous key")
+	}
+
+	otherRing, _ := NewKeyRing(2, bytes.Repeat([]byte{2}, 16))
+	_, err = Open(otherRing, oldSealed, nil)
+	if !errors.Is(err, ErrUnknownKey) {
+		t.Error("expecting unknown key error")
+	}
+
+	if keyRing.Rotate(1, bytes.Repeat([]byte{3}, 16)) == nil {
+		t.Error("expecting error when reusing key id for another key")
+	}
+
+	if _, err = NewKeyRing(1, []byte("short")); err == nil {
+		t.Error("expecting error for invalid key lenght")
+	}
+}
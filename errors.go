@@ -0,0 +1,35 @@
+package engine
+
+import (
+	"errors"
+
+	filestore "github.com/lokidb/engine/v2/file_storage"
+)
+
+// Errors returned by the store, match them with errors.Is
+var (
+	ErrNotFound      = filestore.ErrNotFound
+	ErrInvalidKey    = filestore.ErrInvalidKey
+	ErrInvalidValue  = filestore.ErrInvalidValue
+	ErrValueTooLarge = filestore.ErrValueTooLarge
+	ErrCorrupted     = filestore.ErrCorrupted
+	ErrClosed        = filestore.ErrClosed
+	ErrInvalidTTL    = filestore.ErrInvalidTTL
+
+	// Returned by conditional writes when the condition doesn't hold
+	ErrVersionMismatch = filestore.ErrVersionMismatch
+	ErrKeyExists       = filestore.ErrKeyExists
+
+	// Returned by Reencrypt while snapshots are open and by reads of released snapshots
+	ErrSnapshotOpen     = filestore.ErrSnapshotOpen
+	ErrSnapshotReleased = filestore.ErrSnapshotReleased
+
+	// Returned by mutations of a store opened with WithReadOnly
+	ErrReadOnly = filestore.ErrReadOnly
+)
+
+// Returned by Txn.Commit when a key read by the transaction was changed, the transaction can be retried
+var ErrConflict = errors.New("transaction conflict")
+
+// Returned by operations of a transaction that was already committed or rolled back
+var ErrTxnDone = errors.New("transaction is done")
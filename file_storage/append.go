@@ -0,0 +1,189 @@
+package filestore
+
+// Fragments chained to a value before the value is merged into a single item,
+// it limits the number of items read by Get
+const maxFragments = 64
+
+// Append data to the value of key, the data is written as a fragment item without rewriting the value.
+// Fragments are merged with the value when the chain grows long and on compaction.
+// Appending to a key that doesn't exist sets the key, appending keeps the expiry of the key.
+// Appends that would make the whole value longer than the maximum value lenght return ErrValueTooLarge.
+func (fs *FileKeyValueStore) Append(key string, data []byte) error {
+	fs.lock.Lock()
+
+	err, replaced := fs.iAppend(key, data)
+
+	if replaced && fs.NeedsCompaction() {
+		fs.requestCompaction()
+	}
+
+	seq := fs.syncer.lastWrite()
+	fs.lock.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	return fs.waitDurable(seq)
+}
+
+func (fs *FileKeyValueStore) iAppend(key string, data []byte) (error, bool) {
+	err := isValidKey(key, fs.options.maxKeyLenght)
+	if err != nil {
+		return err, false
+	}
+
+	err = isValidValue(data, fs.options.maxValueLenght)
+	if err != nil {
+		return err, false
+	}
+
+	if err := fs.checkUsable(); err != nil {
+		return err, false
+	}
+
+	if fs.options.readOnly {
+		return ErrReadOnly, false
+	}
+
+	entry, exists := fs.liveEntry(key)
+	if !exists {
+		return fs.iSet(key, data)
+	}
+
+	valueLenght, err := fs.valueLenght(key, entry)
+	if err != nil {
+		return err, false
+	}
+
+	err = isValidValueLenght(valueLenght+int64(len(data)), fs.options.maxValueLenght)
+	if err != nil {
+		return err, false
+	}
+
+	// Long chains are replaced by a single item with the whole value
+	if len(entry.fragments) >= maxFragments {
+		value, err := fs.readValue(entry)
+		if err != nil {
+			return err, false
+		}
+
+		return fs.iSetWithExpiry(key, append(value, data...), entry.expiresAt)
+	}
+
+	it, err := encodeItem(key, data, &fs.options)
+	if err != nil {
+		return err, false
+	}
+	it.flags |= fragmentFlag
+
+	_, err = fs.appendItem(key, it)
+	return err, false
+}
+
+// Read the whole value of the index entry, the value item followed by its fragments
+// that are appended to the value or patch it
+func (fs *FileKeyValueStore) readValue(entry indexEntry) ([]byte, error) {
+	var value []byte
+
+	for i, location := range append([]indexEntry{entry}, entry.fragments...) {
+		view, err := fs.readView(fs.segment(location.segment))
+		if err != nil {
+			return nil, err
+		}
+
+		part, err := getValueFromPosition(view, location.position, fs.options.keyProvider, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		if i == 0 {
+			value = part
+			continue
+		}
+
+		header, err := readItemHeader(view.reader, location.position, view.size, view.version)
+		if err != nil {
+			return nil, asCorruption(err, view, location.position)
+		}
+
+		if header.flags&patchFlag == 0 {
+			value = append(value, part...)
+			continue
+		}
+
+		if header.patchOffset > int64(len(value)) {
+			return nil, &CorruptionError{Path: view.name, Offset: location.position, Reason: "patch beyond the value", next: -1}
+		}
+
+		if end := header.patchOffset + int64(len(part)); end > int64(len(value)) {
+			value = append(value, make([]byte, end-int64(len(value)))...)
+		}
+		copy(value[header.patchOffset:], part)
+	}
+
+	return value, nil
+}
+
+// Lenght of the whole value of the index entry of key, the value is read when the index
+// doesn't know the lenght and the lenght is kept in the index
+func (fs *FileKeyValueStore) valueLenght(key string, entry indexEntry) (int64, error) {
+	if entry.valueLenght > 0 {
+		return entry.valueLenght, nil
+	}
+
+	value, err := fs.readValue(entry)
+	if err != nil {
+		return 0, err
+	}
+
+	entry.valueLenght = int64(len(value))
+	fs.keysIndex[key] = entry
+
+	return entry.valueLenght, nil
+}
+
+// Check if the value item and all the fragments are in the segment
+func (entry indexEntry) inSegment(id uint32) bool {
+	if entry.segment != id {
+		return false
+	}
+
+	for _, fragment := range entry.fragments {
+		if fragment.segment != id {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Check if the entry reads the item of the segment as its value item or as one of its fragments
+func (entry indexEntry) refersTo(id uint32, it item) bool {
+	if it.fragment() {
+		return entry.fragmentIndex(id, it.position) >= 0
+	}
+
+	return entry.segment == id && entry.position == it.position
+}
+
+// Index of the fragment at the position of the segment, or -1 when it is not a fragment of the entry
+func (entry indexEntry) fragmentIndex(id uint32, position int64) int {
+	for i, fragment := range entry.fragments {
+		if fragment.segment == id && fragment.position == position {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// Copy of the entry with new location of the fragment at index i
+func (entry indexEntry) withFragment(i int, location indexEntry) indexEntry {
+	fragments := make([]indexEntry, len(entry.fragments))
+	copy(fragments, entry.fragments)
+	fragments[i] = location
+	entry.fragments = fragments
+
+	return entry
+}
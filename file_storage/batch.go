@@ -0,0 +1,81 @@
+package filestore
+
+// Write of a batch, the value is ignored by deletes
+type BatchOp struct {
+	Key    string
+	Value  []byte
+	Delete bool
+}
+
+// Check that all the writes of the batch are valid, used for making sure a batch
+// that spans several stores is not rejected by one of them after others applied it
+func (fs *FileKeyValueStore) CheckBatch(ops []BatchOp) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	return fs.checkBatch(ops)
+}
+
+func (fs *FileKeyValueStore) checkBatch(ops []BatchOp) error {
+	for _, op := range ops {
+		if err := isValidKey(op.Key, fs.options.maxKeyLenght); err != nil {
+			return err
+		}
+
+		if op.Delete {
+			continue
+		}
+
+		if err := isValidValue(op.Value, fs.options.maxValueLenght); err != nil {
+			return err
+		}
+	}
+
+	if err := fs.checkUsable(); err != nil {
+		return err
+	}
+
+	if fs.options.readOnly {
+		return ErrReadOnly
+	}
+
+	return nil
+}
+
+// Apply the writes of the batch in order under a single lock, the writes are synced to disk
+// before returning regardless of the sync policy. Deletes of keys that don't exist are ignored
+// so applying a batch again has the same result.
+func (fs *FileKeyValueStore) ApplyBatch(ops []BatchOp) error {
+	fs.lock.Lock()
+
+	err := fs.checkBatch(ops)
+	replaced := false
+
+	for _, op := range ops {
+		if err != nil {
+			break
+		}
+
+		var r bool
+		if !op.Delete {
+			err, r = fs.iSet(op.Key, op.Value)
+		} else if _, exists := fs.liveEntry(op.Key); exists {
+			err, r = fs.iDel(op.Key)
+		}
+
+		replaced = replaced || r
+	}
+
+	if replaced && fs.NeedsCompaction() {
+		fs.requestCompaction()
+	}
+
+	seq := fs.syncer.lastWrite()
+	fs.lock.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	return fs.syncer.wait(seq)
+}
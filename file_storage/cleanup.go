@@ -2,64 +2,307 @@ package filestore
 
 import (
 	"context"
-	"io/fs"
+	"log"
 	"os"
 )
 
-// Check deleted keys ratio and decide if cleanup is required
-func (fst *FileKeyValueStore) isCleanupRequired() bool {
-	// If deleted count is more then <cleanupOnDeletedPercentage> of all the keys, start cleanup
-	fst.deletedKeyCount++
-	totalKeys := len(fst.keysIndex) + fst.deletedKeyCount
-	doCleanup := fst.deletedKeyCount > minDeletedKeyForCleanup && float64(totalKeys)*cleanupOnDeletedRatio <= float64(fst.deletedKeyCount)
+// Decide when a segment has enough deleted items to be worth compacting
+type CompactionPolicy struct {
+	// Minimum ratio of deleted items bytes out of the segment size
+	MinDeadRatio float64
+	// Minimum size in bytes of deleted items
+	MinDeadBytes int64
+}
+
+var DefaultCompactionPolicy = CompactionPolicy{
+	MinDeadRatio: 0.3,
+	MinDeadBytes: 4096,
+}
+
+// Limit the rate of bytes written by compaction, compatible with golang.org/x/time/rate.Limiter
+type RateLimiter interface {
+	WaitN(ctx context.Context, n int) error
+}
+
+// Check if any of the segments needs compaction
+func (fst *FileKeyValueStore) NeedsCompaction() bool {
+	for _, seg := range fst.segments {
+		if fst.segmentNeedsCompaction(seg) {
+			return true
+		}
+	}
 
-	return doCleanup
+	return false
 }
 
+// Check the dead bytes ratio of the segment and decide if compaction is required,
+// dead items that are kept for open snapshots are not counted
+func (fst *FileKeyValueStore) segmentNeedsCompaction(seg *segment) bool {
+	policy := fst.options.compactionPolicy
+	itemsSize := seg.itemsSize()
+	deadBytes := seg.deadBytes - seg.pinnedBytes
+
+	if deadBytes <= 0 || itemsSize <= 0 || deadBytes < policy.MinDeadBytes {
+		return false
+	}
+
+	return float64(deadBytes)/float64(itemsSize) >= policy.MinDeadRatio
+}
+
+// Rewrite the segments that need compaction without their deleted items
+func (fst *FileKeyValueStore) Compact(ctx context.Context) error {
+	return fst.rewrite(ctx, fst.segmentNeedsCompaction)
+}
+
+// Ask the compaction trigger to schedule compaction, without trigger compaction runs in the background
+func (fst *FileKeyValueStore) requestCompaction() {
+	if fst.options.compactionTrigger != nil {
+		fst.options.compactionTrigger(fst)
+		return
+	}
+
+	go func() {
+		if err := fst.Compact(context.Background()); err != nil {
+			log.Printf("filestore: compaction of %s failed: %v", fst.filePath, err)
+		}
+	}()
+}
+
+// Rewrite every segment with deleted items that are not kept for open snapshots
 func (fst *FileKeyValueStore) cleanUp(ctx context.Context) error {
+	return fst.rewrite(ctx, func(seg *segment) bool {
+		return seg.deadBytes > seg.pinnedBytes
+	})
+}
+
+// Rewrite the selected segments, segments are selected again when the lock is acquired
+// so segments that were already compacted by earlier request are skipped
+func (fst *FileKeyValueStore) rewrite(ctx context.Context, selected func(*segment) bool) error {
 	fst.lock.Lock()
 	defer fst.lock.Unlock()
 
-	// Open items file
-	file, err := os.OpenFile(fst.filePath, os.O_RDWR, fs.FileMode(filePermissions))
-	if err != nil {
-		panic(err)
+	if err := fst.checkUsable(); err != nil {
+		return err
+	}
+
+	if fst.options.readOnly {
+		return ErrReadOnly
+	}
+
+	// Expired keys become dead items that the rewrite reclaims
+	if _, err := fst.deleteExpired(); err != nil {
+		return err
+	}
+
+	rewritten := false
+	for _, seg := range fst.segments {
+		if !selected(seg) {
+			continue
+		}
+
+		if err := fst.rewriteSegment(ctx, seg); err != nil {
+			return err
+		}
+
+		rewritten = true
+	}
+
+	if !rewritten {
+		return nil
 	}
 
-	// Create new file for non-deleted items
-	cleanFile, err := os.Create(fst.filePath + cleanFileExtension)
+	return fst.writeHint()
+}
+
+// Rewrite the segment without the dead items, items that are not encrypted with
+// the current key are encrypted again and values with all their fragments in the segment are merged.
+// Items that open snapshots read are kept and the snapshots are moved to their new locations.
+func (fst *FileKeyValueStore) rewriteSegment(ctx context.Context, seg *segment) error {
+	// Create new file for the live items
+	cleanPath := seg.path + cleanFileExtension
+	cleanFile, err := os.Create(cleanPath)
 	if err != nil {
 		return err
 	}
+	defer os.Remove(cleanPath)
+	defer cleanFile.Close()
+
+	// The clean file keeps the sequence of the items that are dropped
+	header := newFileHeader(&fst.options)
+	header.sequence = seg.sequence
+	if err = writeFileHeader(cleanFile, header); err != nil {
+		return err
+	}
+
+	// Scan the segment and insert the items that are still in the keys index or in the index of
+	// an open snapshot to the new file, the indexes are updated only after the new file is ready
+	indexes := []map[string]indexEntry{fst.keysIndex}
+	for snap := range fst.snapshots {
+		indexes = append(indexes, snap.keysIndex)
+	}
 
-	// Scan currenct file and insert all non-deleted items to new file
-	err = scanFile(ctx, file, true, func(key string, value []byte, deleted bool, filePosition int64) {
-		if !deleted {
-			itemPosition, err := insertItemToFile(cleanFile, key, value)
-			if err != nil {
-				panic(err)
+	cleanEntries := make([]map[string]indexEntry, len(indexes))
+	for i := range cleanEntries {
+		cleanEntries[i] = make(map[string]indexEntry)
+	}
+
+	var pinnedBytes int64
+	pinnedCount := 0
+	cleanFileSize := int64(fileHeaderLenght)
+	limiter := fst.options.compactionRateLimiter
+
+	// Tombstones are needed only while older segments may have items of the deleted key,
+	// segments without dead items have only items that are in the index.
+	// Items kept for snapshots may be deleted by tombstones of the same segment.
+	olderSegmentsClean := len(fst.snapshots) == 0
+	for _, older := range fst.segments {
+		if older.id < seg.id && older.deadBytes > 0 {
+			olderSegmentsClean = false
+		}
+	}
+
+	var insertErr error
+	err = scanFile(ctx, seg.fileView(), itemsOffset(seg.version), func(it item) {
+		if insertErr != nil {
+			return
+		}
+
+		key, err := decodeItemKey(it, fst.options.keyProvider)
+		if err != nil {
+			insertErr = err
+			return
+		}
+
+		// Snapshots read the fragments of the value as they were when the snapshot was created
+		entry, exists := fst.keysIndex[key]
+		merge := exists && len(entry.fragments) > 0 && entry.inSegment(seg.id) && len(fst.snapshots) == 0
+
+		// Indexes that read the item
+		var readers []int
+		for i, keysIndex := range indexes {
+			if indexed, exists := keysIndex[key]; exists && indexed.refersTo(seg.id, it) {
+				readers = append(readers, i)
 			}
-			fst.keysIndex[key] = itemPosition
 		}
+
+		switch {
+		case it.tombstone():
+			// The key was set again after the tombstone or there is nothing left to delete
+			if exists || olderSegmentsClean {
+				return
+			}
+		case merge && it.fragment():
+			// Merged fragments are written as part of the value item
+			return
+		case len(readers) == 0:
+			return
+		}
+
+		if limiter != nil {
+			if insertErr = limiter.WaitN(ctx, int(it.size)); insertErr != nil {
+				return
+			}
+		}
+
+		if it.tombstone() {
+			sequence := it.sequence
+			it, err = encodeTombstone(key, &fst.options)
+			it.setSequence(sequence)
+		} else if merge {
+			var value []byte
+			if value, err = fst.readValue(entry); err == nil {
+				it, err = encodeItem(key, value, &fst.options)
+				it.setExpiry(entry.expiresAt)
+				it.setSequence(entry.version)
+			}
+		} else if reencrypt, checkErr := needsReencryption(it, &fst.options); checkErr != nil {
+			err = checkErr
+		} else if reencrypt {
+			it, err = reencodeItem(it, &fst.options)
+		}
+
+		if err != nil {
+			insertErr = err
+			return
+		}
+
+		var itemSize int64
+		itemSize, insertErr = insertItemToFile(cleanFile, cleanFileSize, it)
+
+		for _, i := range readers {
+			entry := indexes[i][key]
+			location := indexEntry{segment: seg.id, position: cleanFileSize, size: itemSize, expiresAt: entry.expiresAt, version: entry.version, valueLenght: entry.valueLenght}
+
+			// Fragments come after their value item so the entry may already be moved
+			if clean, moved := cleanEntries[i][key]; moved {
+				entry = clean
+			}
+
+			switch {
+			case merge:
+				cleanEntries[i][key] = location
+			case it.fragment():
+				cleanEntries[i][key] = entry.withFragment(entry.fragmentIndex(seg.id, it.position), location)
+			default:
+				location.fragments = entry.fragments
+				cleanEntries[i][key] = location
+			}
+		}
+
+		// Items that only snapshots read are dead items of the clean segment
+		if len(readers) > 0 && readers[0] != 0 {
+			pinnedBytes += itemSize
+			pinnedCount++
+		}
+		cleanFileSize += itemSize
 	})
 
 	if err != nil {
 		return err
 	}
 
-	fst.deletedKeyCount = 0
+	if insertErr != nil {
+		return insertErr
+	}
+
+	// Make the clean file durable before it replaces the original file,
+	// a crash at any point leaves either the original or the clean file in place
+	if err = cleanFile.Sync(); err != nil {
+		return err
+	}
+
+	if err = cleanFile.Close(); err != nil {
+		return err
+	}
+
+	fst.invalidateHint()
 
-	// Close both files delete the old one and rename the updated one
-	cleanFile.Close()
-	file.Close()
+	writable := seg == fst.active()
+	fst.handlesLock.Lock()
+	seg.close()
+	fst.handlesLock.Unlock()
+
+	if err = os.Rename(cleanPath, seg.path); err != nil {
+		// The original file is still in place when the rename fails
+		if openErr := fst.openSegment(seg, writable); openErr != nil {
+			return openErr
+		}
 
-	if err = os.Remove(fst.filePath); err != nil {
 		return err
 	}
 
-	if err = os.Rename(fst.filePath+cleanFileExtension, fst.filePath); err != nil {
-		panic(err)
+	for i, keysIndex := range indexes {
+		for key, entry := range cleanEntries[i] {
+			keysIndex[key] = entry
+		}
+	}
+	seg.deletedKeyCount = pinnedCount
+	seg.deadBytes = pinnedBytes
+	seg.pinnedBytes = pinnedBytes
+
+	if err = fst.openSegment(seg, writable); err != nil {
+		return err
 	}
 
-	return nil
+	return syncDir(seg.path)
 }
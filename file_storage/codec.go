@@ -0,0 +1,161 @@
+package filestore
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Codec ids stored in the item header, ids up to 15 are reserved for built-in codecs
+const (
+	NoCompression byte = 0
+	DeflateCodec  byte = 1
+	GzipCodec     byte = 2
+)
+
+const maxReservedCodecID = 15
+
+// Compression codec of item values
+type Codec interface {
+	ID() byte
+	Compress(value []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+var codecsLock sync.RWMutex
+var codecs = map[byte]Codec{
+	DeflateCodec: deflateCodec{},
+	GzipCodec:    gzipCodec{},
+}
+
+// Register custom codec, files written with the codec can be read only when it is registered
+func RegisterCodec(codec Codec) error {
+	codecsLock.Lock()
+	defer codecsLock.Unlock()
+
+	if codec.ID() <= maxReservedCodecID {
+		return fmt.Errorf("codec id %d is reserved", codec.ID())
+	}
+
+	if _, exists := codecs[codec.ID()]; exists {
+		return fmt.Errorf("codec id %d is already registered", codec.ID())
+	}
+
+	codecs[codec.ID()] = codec
+
+	return nil
+}
+
+func getCodec(id byte) (Codec, error) {
+	codecsLock.RLock()
+	defer codecsLock.RUnlock()
+
+	codec, exists := codecs[id]
+	if !exists {
+		return nil, fmt.Errorf("unknown compression codec %d", id)
+	}
+
+	return codec, nil
+}
+
+// Compress the value when it is larger then the threshold and the compression saves space
+func encodeValue(value []byte, codecID byte, threshold int) ([]byte, byte, error) {
+	if codecID == NoCompression || len(value) < threshold {
+		return value, NoCompression, nil
+	}
+
+	codec, err := getCodec(codecID)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	compressed, err := codec.Compress(value)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if len(compressed) >= len(value) {
+		return value, NoCompression, nil
+	}
+
+	return compressed, codecID, nil
+}
+
+func decodeValue(data []byte, codecID byte) ([]byte, error) {
+	if codecID == NoCompression {
+		return data, nil
+	}
+
+	codec, err := getCodec(codecID)
+	if err != nil {
+		return nil, err
+	}
+
+	return codec.Decompress(data)
+}
+
+type deflateCodec struct{}
+
+func (deflateCodec) ID() byte {
+	return DeflateCodec
+}
+
+func (deflateCodec) Compress(value []byte) ([]byte, error) {
+	var buf bytes.Buffer
+
+	writer, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = writer.Write(value); err != nil {
+		return nil, err
+	}
+
+	if err = writer.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (deflateCodec) Decompress(data []byte) ([]byte, error) {
+	reader := flate.NewReader(bytes.NewReader(data))
+	defer reader.Close()
+
+	return io.ReadAll(reader)
+}
+
+type gzipCodec struct{}
+
+func (gzipCodec) ID() byte {
+	return GzipCodec
+}
+
+func (gzipCodec) Compress(value []byte) ([]byte, error) {
+	var buf bytes.Buffer
+
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write(value); err != nil {
+		return nil, err
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (gzipCodec) Decompress(data []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return io.ReadAll(reader)
+}
@@ -0,0 +1,183 @@
+package filestore
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Decide when written items are flushed to disk with fsync
+type SyncPolicy int
+
+const (
+	// Leave flushing to the operating system, writes since the last sync may be lost on power loss
+	SyncNever SyncPolicy = iota
+	// Sync in the background every interval, at most one interval of writes may be lost
+	SyncInterval
+	// Sync before Set and Del return, concurrent writes are synced together by a single fsync
+	SyncAlways
+)
+
+// Group commit of writes, every write gets a sequence number and waiting writers
+// are synced together by the first waiter.
+// A failed sync is sticky, after a failed fsync it is unknown which writes reached the disk
+// so the writes that were not synced before the failure never report success.
+type groupSyncer struct {
+	written  uint64
+	synced   uint64
+	syncing  bool
+	err      error
+	syncFile func() error
+	lock     sync.Mutex
+	cond     *sync.Cond
+}
+
+func newGroupSyncer(syncFile func() error) *groupSyncer {
+	g := &groupSyncer{syncFile: syncFile}
+	g.cond = sync.NewCond(&g.lock)
+
+	return g
+}
+
+// Register a write and return its sequence number
+func (g *groupSyncer) write() uint64 {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	g.written++
+
+	return g.written
+}
+
+// Sequence number of the last write
+func (g *groupSyncer) lastWrite() uint64 {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	return g.written
+}
+
+// Check if all the writes are synced
+func (g *groupSyncer) isSynced() bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	return g.synced == g.written
+}
+
+// Error of the failed sync, nil while all the syncs succeeded
+func (g *groupSyncer) failure() error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	return g.err
+}
+
+// Wait until the write with the sequence number is on disk, when no sync is running
+// the caller syncs all the writes done so far
+func (g *groupSyncer) wait(seq uint64) error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	for g.synced < seq && g.err == nil {
+		if g.syncing {
+			g.cond.Wait()
+			continue
+		}
+
+		g.syncWritten()
+	}
+
+	if g.synced >= seq {
+		return nil
+	}
+
+	return g.err
+}
+
+// Sync the writes that are not synced yet
+func (g *groupSyncer) syncPending() error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if g.err != nil {
+		return g.err
+	}
+
+	if g.syncing || g.synced == g.written {
+		return nil
+	}
+
+	g.syncWritten()
+
+	return g.err
+}
+
+// Called with g.lock held, the lock is released while syncing so writers can
+// keep writing and join the next sync
+func (g *groupSyncer) syncWritten() {
+	target := g.written
+	g.syncing = true
+	g.lock.Unlock()
+
+	err := g.syncFile()
+
+	g.lock.Lock()
+	g.syncing = false
+	if err != nil && g.err == nil {
+		g.err = err
+	}
+
+	if g.err == nil {
+		g.synced = target
+	}
+	g.cond.Broadcast()
+}
+
+// Sync the write handles, the handles are closed only after the data is synced
+// (compaction and close) or removed (flush) so closed handles have nothing to sync
+func (fs *FileKeyValueStore) syncWriter() error {
+	fs.handlesLock.RLock()
+	defer fs.handlesLock.RUnlock()
+
+	for _, seg := range fs.segments {
+		if seg.writer == nil {
+			continue
+		}
+
+		if err := seg.writer.Sync(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Wait for the writes done so far according to the sync policy, called without the store lock
+func (fs *FileKeyValueStore) waitDurable(seq uint64) error {
+	if fs.options.syncPolicy != SyncAlways {
+		return nil
+	}
+
+	return fs.syncer.wait(seq)
+}
+
+func (fs *FileKeyValueStore) startSyncLoop() {
+	fs.stopSync = make(chan struct{})
+
+	go func(stop chan struct{}) {
+		ticker := time.NewTicker(fs.options.syncInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := fs.syncer.syncPending(); err != nil {
+					log.Printf("filestore: sync of %s failed: %v", fs.filePath, err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}(fs.stopSync)
+}
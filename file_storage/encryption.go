@@ -0,0 +1,151 @@
+package filestore
+
+import (
+	"context"
+	"errors"
+
+	"github.com/lokidb/engine/v2/encryption"
+)
+
+var ErrMissingKeyProvider = errors.New("encrypted item requires a key provider")
+
+// Compress and encrypt key value according to the options, the value is
+// authenticated together with the stored key so items can't be swapped
+func encodeItem(key string, value []byte, opts *options) (item, error) {
+	storedValue, codec, err := encodeValue(value, opts.compressionCodec, opts.compressionThreshold)
+	if err != nil {
+		return item{}, err
+	}
+
+	it := item{key: key, value: storedValue, codec: codec, valueLenght: int64(len(value))}
+	if opts.keyProvider == nil {
+		return it, nil
+	}
+
+	if opts.encryptKeys {
+		sealedKey, err := encryption.Seal(opts.keyProvider, []byte(key), nil)
+		if err != nil {
+			return item{}, err
+		}
+
+		it.key = string(sealedKey)
+		it.flags |= encryptedKeyFlag
+	}
+
+	it.value, err = encryption.Seal(opts.keyProvider, storedValue, []byte(it.key))
+	if err != nil {
+		return item{}, err
+	}
+	it.flags |= encryptedValueFlag
+
+	return it, nil
+}
+
+// Tombstone item of the deleted key, only the key is encrypted
+func encodeTombstone(key string, opts *options) (item, error) {
+	it := item{key: key, flags: tombstoneFlag}
+
+	if opts.keyProvider != nil && opts.encryptKeys {
+		sealedKey, err := encryption.Seal(opts.keyProvider, []byte(key), nil)
+		if err != nil {
+			return item{}, err
+		}
+
+		it.key = string(sealedKey)
+		it.flags |= encryptedKeyFlag
+	}
+
+	return it, nil
+}
+
+// Decrypt and decompress the value of item read from file
+func decodeItemValue(it item, provider encryption.KeyProvider) ([]byte, error) {
+	value := it.value
+
+	if it.flags&encryptedValueFlag != 0 {
+		if provider == nil {
+			return nil, ErrMissingKeyProvider
+		}
+
+		var err error
+		value, err = encryption.Open(provider, value, []byte(it.key))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return decodeValue(value, it.codec)
+}
+
+func decodeItemKey(it item, provider encryption.KeyProvider) (string, error) {
+	if it.flags&encryptedKeyFlag == 0 {
+		return it.key, nil
+	}
+
+	if provider == nil {
+		return "", ErrMissingKeyProvider
+	}
+
+	key, err := encryption.Open(provider, []byte(it.key), nil)
+	if err != nil {
+		return "", err
+	}
+
+	return string(key), nil
+}
+
+// Check if the item is not encrypted the way new items are, with the current key
+func needsReencryption(it item, opts *options) (bool, error) {
+	if opts.keyProvider == nil {
+		return false, nil
+	}
+
+	if it.flags&encryptedValueFlag == 0 || opts.encryptKeys != (it.flags&encryptedKeyFlag != 0) {
+		return true, nil
+	}
+
+	currentID, _, err := opts.keyProvider.CurrentKey()
+	if err != nil {
+		return false, err
+	}
+
+	id, err := encryption.KeyID(it.value)
+	if err != nil {
+		return false, err
+	}
+
+	return id != currentID, nil
+}
+
+// Encode the item again with the current options
+func reencodeItem(it item, opts *options) (item, error) {
+	key, err := decodeItemKey(it, opts.keyProvider)
+	if err != nil {
+		return item{}, err
+	}
+
+	value, err := decodeItemValue(it, opts.keyProvider)
+	if err != nil {
+		return item{}, err
+	}
+
+	encoded, err := encodeItem(key, value, opts)
+	encoded.flags |= it.flags & fragmentFlag
+	if it.patch() {
+		encoded.setPatch(it.patchOffset)
+	}
+	encoded.setExpiry(it.expiresAt)
+	if it.flags&sequenceFlag != 0 {
+		encoded.setSequence(it.sequence)
+	}
+
+	return encoded, err
+}
+
+// Rewrite all the segments so every item is encrypted with the current key,
+// used after key rotation or after enabling encryption on existing files.
+func (fst *FileKeyValueStore) Reencrypt(ctx context.Context) error {
+	return fst.rewrite(ctx, func(*segment) bool {
+		return true
+	})
+}
@@ -0,0 +1,38 @@
+package filestore
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrNotFound = errors.New("key not found")
+var ErrInvalidKey = errors.New("invalid key")
+var ErrInvalidValue = errors.New("invalid value")
+var ErrValueTooLarge = errors.New("value too large")
+var ErrCorrupted = errors.New("corrupted data")
+var ErrClosed = errors.New("file store is closed")
+var ErrReadOnly = errors.New("file store is read-only")
+var ErrInvalidTTL = errors.New("invalid ttl")
+var ErrVersionMismatch = errors.New("key version mismatch")
+var ErrKeyExists = errors.New("key already exists")
+var ErrSnapshotOpen = errors.New("snapshot is open")
+var ErrSnapshotReleased = errors.New("snapshot is released")
+
+// Returned when an item on disk does not match its checksum or is truncated
+type CorruptionError struct {
+	Path   string
+	Offset int64
+	Reason string
+
+	// position of the next item, or -1 when the item lenght can't be trusted
+	next int64
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("corrupted item in %s at position %d: %s", e.Path, e.Offset, e.Reason)
+}
+
+// Corruption errors match ErrCorrupted with errors.Is
+func (e *CorruptionError) Is(target error) bool {
+	return target == ErrCorrupted
+}
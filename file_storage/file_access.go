@@ -1,132 +1,518 @@
 package filestore
 
 import (
+	"bytes"
 	"context"
 	"encoding/binary"
+	"errors"
+	"hash/crc32"
 	"io"
 	"os"
 
-	"github.com/lokidb/engine/cursor"
+	"github.com/lokidb/engine/v2/cursor"
+	"github.com/lokidb/engine/v2/encryption"
 )
 
-func getValueFromPosition(file *os.File, itemPosition int64, valueReader func(cursor.Cursor) ([]byte, error)) ([]byte, error) {
-	_, err := file.Seek(int64(itemPosition), io.SeekStart)
-	if err != nil {
-		return nil, err
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Item layout (format version 9):
+//
+//	checksum (4 bytes) | item flags (1 byte) | codec (1 byte) | [sequence (8 bytes)] | [expiry (uvarint)] |
+//	[patch offset (uvarint)] | key lenght (uvarint) | value lenght (uvarint) | key | value
+//
+// the checksum covers everything after it. Items are not changed once written except in place patches of
+// values in the active segment, deletes are appended as tombstone items and the latest item of a key wins.
+// Fragment items hold data appended to the value of the previous items of the key, fragments with the patch flag
+// overwrite the value from the patch offset.
+// The value is stored encoded with the codec, value lenght is the lenght of the encoded value.
+// Items with the sequence flag have the sequence number of the write that is used as the key version.
+// Items with the expires flag have the expiry time in unix milliseconds.
+// Versions 6 to 8 items are valid items without patches, version 6 and 7 also without sequence
+// and version 6 also without expiry.
+// Format versions 3 to 5 have a deleted flag byte after the checksum that was changed in place and is not
+// covered by the checksum, version 4 has no item flags byte and version 3 also no codec byte.
+const checksumLenght = 4
+const deletedFlagOffset = 4
+const sequenceLenght = 8
+const maxItemHeaderLenght = checksumLenght + 3 + sequenceLenght + 4*binary.MaxVarintLen64
+
+// Item flags
+const (
+	encryptedValueFlag byte = 1 << iota
+	encryptedKeyFlag
+	tombstoneFlag
+	fragmentFlag
+	expiresFlag
+	sequenceFlag
+	patchFlag
+)
+
+// Item header size before checksums were added (format versions 0 and 1)
+const legacyItemHeaderLenght = 5
+
+// Item header size of format version 2, legacy header followed by checksum
+const checksumItemHeaderLenght = 9
+
+// Item read from a data file
+type item struct {
+	key       string
+	value     []byte // encoded value
+	flags     byte
+	codec     byte
+	expiresAt int64  // unix milliseconds, 0 for items that never expire
+	sequence  uint64 // sequence number of the write, 0 for items written before format version 8
+	deleted   bool   // deleted in place, only in format versions before 6
+	position  int64
+	size      int64
+
+	patchOffset int64 // offset in the value overwritten by patch items
+	valueLenght int64 // lenght of the decoded value, set only when the item is encoded
+}
+
+// Lenght of the decoded value, 0 when it is not known without decoding the value
+func (it item) decodedLenght() int64 {
+	if it.valueLenght > 0 || it.codec != NoCompression || it.flags&encryptedValueFlag != 0 {
+		return it.valueLenght
 	}
 
-	itemHeader := make([]byte, itemHeaderLenght)
-	_, err = file.Read(itemHeader)
-	if err != nil {
-		return nil, err
+	return int64(len(it.value))
+}
+
+type itemHeader struct {
+	checksum    uint32
+	deleted     bool
+	flags       byte
+	codec       byte
+	expiresAt   int64
+	sequence    uint64
+	patchOffset int64
+	keyLenght   int64
+	valueLenght int64
+	size        int64  // lenght of the encoded header
+	checksummed []byte // header bytes covered by the checksum
+}
+
+func (h itemHeader) itemSize() int64 {
+	return h.size + h.keyLenght + h.valueLenght
+}
+
+func (h itemHeader) valid(key []byte, value []byte) bool {
+	crc := crc32.Update(0, crcTable, h.checksummed)
+	crc = crc32.Update(crc, crcTable, key)
+	return crc32.Update(crc, crcTable, value) == h.checksum
+}
+
+func (it item) tombstone() bool {
+	return it.flags&tombstoneFlag != 0
+}
+
+func (it item) fragment() bool {
+	return it.flags&fragmentFlag != 0
+}
+
+func (it item) patch() bool {
+	return it.flags&patchFlag != 0
+}
+
+// Make the item a fragment that overwrites the value from offset
+func (it *item) setPatch(offset int64) {
+	it.patchOffset = offset
+	it.flags |= fragmentFlag | patchFlag
+}
+
+// Set the expiry time of the item, zero time removes the expiry
+func (it *item) setExpiry(expiresAt int64) {
+	it.expiresAt = expiresAt
+	it.flags &^= expiresFlag
+	if expiresAt != 0 {
+		it.flags |= expiresFlag
 	}
+}
 
-	valuePosition, err := file.Seek(int64(itemHeader[0]), io.SeekCurrent)
-	if err != nil {
-		return nil, err
+func (it *item) setSequence(sequence uint64) {
+	it.sequence = sequence
+	it.flags |= sequenceFlag
+}
+
+func encodeItemHeader(it item) []byte {
+	itemHeader := encodeItemHeaderFields(it, int64(len(it.value)))
+
+	crc := crc32.Update(0, crcTable, itemHeader[checksumLenght:])
+	crc = crc32.Update(crc, crcTable, []byte(it.key))
+	crc = crc32.Update(crc, crcTable, it.value)
+	binary.LittleEndian.PutUint32(itemHeader, crc)
+
+	return itemHeader
+}
+
+// Encode the item header with zero checksum, used directly when the value is streamed
+// and the checksum is known only after the value is written
+func encodeItemHeaderFields(it item, valueLenght int64) []byte {
+	itemHeader := make([]byte, maxItemHeaderLenght)
+	itemHeader[checksumLenght] = it.flags
+	itemHeader[checksumLenght+1] = it.codec
+	n := checksumLenght + 2
+	if it.flags&sequenceFlag != 0 {
+		binary.LittleEndian.PutUint64(itemHeader[n:], it.sequence)
+		n += sequenceLenght
+	}
+	if it.flags&expiresFlag != 0 {
+		n += binary.PutUvarint(itemHeader[n:], uint64(it.expiresAt))
 	}
+	if it.flags&patchFlag != 0 {
+		n += binary.PutUvarint(itemHeader[n:], uint64(it.patchOffset))
+	}
+	n += binary.PutUvarint(itemHeader[n:], uint64(len(it.key)))
+	n += binary.PutUvarint(itemHeader[n:], uint64(valueLenght))
 
-	valueLenght := binary.LittleEndian.Uint16(itemHeader[1:4])
+	return itemHeader[:n]
+}
 
-	cur := cursor.New(file, valuePosition, int64(valueLenght))
-	if valueReader != nil {
-		return valueReader(cur)
+// Read and decode the header of the item at the given position, fileSize is used
+// to detect items that were not fully written
+func readItemHeader(file io.ReaderAt, itemPosition int64, fileSize int64, version uint16) (itemHeader, error) {
+	buf := make([]byte, maxItemHeaderLenght)
+	n, err := file.ReadAt(buf, itemPosition)
+	if err != nil && err != io.EOF {
+		return itemHeader{}, err
 	}
+	buf = buf[:n]
 
-	value := make([]byte, valueLenght)
-	_, err = file.Read(value)
+	var h itemHeader
+
+	switch {
+	case version < 3:
+		headerSize := legacyItemHeaderLenght
+		if version == 2 {
+			headerSize = checksumItemHeaderLenght
+		}
+
+		if len(buf) < headerSize {
+			return itemHeader{}, errIncompleteItem
+		}
+
+		h.keyLenght = int64(buf[0])
+		h.valueLenght = int64(buf[1]) | int64(buf[2])<<8 | int64(buf[3])<<16
+		h.deleted = buf[4] == 1
+		h.size = int64(headerSize)
+		h.checksummed = buf[:4]
+
+		if buf[4] > 1 {
+			return itemHeader{}, errInvalidItemHeader
+		}
+
+		if version == 2 {
+			h.checksum = binary.LittleEndian.Uint32(buf[5:9])
+		}
+	default:
+		if len(buf) < checksumLenght+1 {
+			return itemHeader{}, errIncompleteItem
+		}
+
+		h.checksum = binary.LittleEndian.Uint32(buf)
+		offset := checksumLenght
+
+		if version < 6 {
+			h.deleted = buf[deletedFlagOffset] == 1
+			if buf[deletedFlagOffset] > 1 {
+				return itemHeader{}, errInvalidItemHeader
+			}
+
+			offset++
+		}
+
+		// The deleted flag is not covered by the checksum
+		checksumStart := offset
+
+		if version >= 5 {
+			if len(buf) <= offset {
+				return itemHeader{}, errIncompleteItem
+			}
+
+			h.flags = buf[offset]
+			offset++
+		}
+
+		if version >= 4 {
+			if len(buf) <= offset {
+				return itemHeader{}, errIncompleteItem
+			}
+
+			h.codec = buf[offset]
+			offset++
+		}
+
+		if version >= 8 && h.flags&sequenceFlag != 0 {
+			if len(buf) < offset+sequenceLenght {
+				return itemHeader{}, errIncompleteItem
+			}
+
+			h.sequence = binary.LittleEndian.Uint64(buf[offset:])
+			offset += sequenceLenght
+		}
+
+		if version >= 7 && h.flags&expiresFlag != 0 {
+			expiresAt, n := binary.Uvarint(buf[offset:])
+			if n <= 0 {
+				return itemHeader{}, varintError(n)
+			}
+
+			h.expiresAt = int64(expiresAt)
+			offset += n
+		}
+
+		if version >= 9 && h.flags&patchFlag != 0 {
+			patchOffset, n := binary.Uvarint(buf[offset:])
+			if n <= 0 {
+				return itemHeader{}, varintError(n)
+			}
+
+			h.patchOffset = int64(patchOffset)
+			offset += n
+		}
+
+		keyLenght, kn := binary.Uvarint(buf[offset:])
+		if kn <= 0 {
+			return itemHeader{}, varintError(kn)
+		}
+
+		valueLenght, vn := binary.Uvarint(buf[offset+kn:])
+		if vn <= 0 {
+			return itemHeader{}, varintError(vn)
+		}
+
+		h.size = int64(offset + kn + vn)
+		h.checksummed = buf[checksumStart:h.size]
+
+		// Lenghts that overflow can't belong to a real item
+		if keyLenght > uint64(fileSize) || valueLenght > uint64(fileSize) {
+			return itemHeader{}, errIncompleteItem
+		}
+
+		h.keyLenght = int64(keyLenght)
+		h.valueLenght = int64(valueLenght)
+	}
+
+	if h.keyLenght == 0 {
+		return itemHeader{}, errInvalidItemHeader
+	}
+
+	if itemPosition+h.itemSize() > fileSize {
+		return itemHeader{}, errIncompleteItem
+	}
+
+	return h, nil
+}
+
+var errIncompleteItem = errors.New("incomplete item")
+var errInvalidItemHeader = errors.New("invalid item header")
+
+// Uvarint reports buffer too small with 0 and overflow with negative value
+func varintError(n int) error {
+	if n == 0 {
+		return errIncompleteItem
+	}
+
+	return errInvalidItemHeader
+}
+
+// Random access view of a data file, backed by the file itself or by its memory mapping
+type dataView struct {
+	reader  io.ReaderAt
+	size    int64
+	name    string
+	version uint16 // format version of the data file
+}
+
+func fileView(file *os.File, version uint16) (dataView, error) {
+	fileInfo, err := file.Stat()
 	if err != nil {
-		return nil, err
+		return dataView{}, err
 	}
 
-	return value, nil
+	return dataView{reader: file, size: fileInfo.Size(), name: file.Name(), version: version}, nil
 }
 
-func insertItemToFile(file *os.File, key string, value []byte) (int64, error) {
-	// Jump to end of file
-	itemPosition, err := file.Seek(0, io.SeekEnd)
+func getValueFromPosition(view dataView, itemPosition int64, provider encryption.KeyProvider, valueReader func(cursor.Cursor) ([]byte, error)) ([]byte, error) {
+	header, err := readItemHeader(view.reader, itemPosition, view.size, view.version)
 	if err != nil {
-		return 0, err
+		return nil, asCorruption(err, view, itemPosition)
 	}
 
-	// Item header is 32 int with 1 first byte as key size and 3 other bytes for total lenght
-	itemHeader := make([]byte, 5)
-	itemHeader[4] = 0
-	binary.LittleEndian.PutUint32(itemHeader, (uint32(len(value))<<8)+uint32(len(key)))
+	valuePosition := itemPosition + header.size + header.keyLenght
 
-	// create itemBytes from itemHeader and keyValue bytes
-	item := append([]byte(key), value...)
-	itemBytes := append(itemHeader, item...)
+	// Partial reads can't be verified against the item checksum, compressed
+	// and encrypted values are decoded first and the cursor reads the decoded value
+	if valueReader != nil && header.codec == NoCompression && header.flags&encryptedValueFlag == 0 {
+		return valueReader(cursor.New(view.reader, valuePosition, header.valueLenght))
+	}
 
-	_, err = file.Write(itemBytes)
+	itemBytes := make([]byte, header.keyLenght+header.valueLenght)
+	_, err = view.reader.ReadAt(itemBytes, itemPosition+header.size)
 	if err != nil {
-		return 0, err
+		return nil, asCorruption(err, view, itemPosition)
 	}
 
-	return itemPosition, nil
-}
+	key, value := itemBytes[:header.keyLenght], itemBytes[header.keyLenght:]
+	if view.version >= 2 && !header.valid(key, value) {
+		return nil, &CorruptionError{Path: view.name, Offset: itemPosition, Reason: "checksum mismatch", next: -1}
+	}
 
-func markItemAsDeletedOnFile(file *os.File, itemPosition int64) error {
-	// Jump to item header last byte (the byte that represent if the item is deleted)
-	_, err := file.Seek(int64(itemPosition)+itemHeaderLenght-1, io.SeekStart)
+	value, err = decodeItemValue(item{key: string(key), value: value, flags: header.flags, codec: header.codec}, provider)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// Overwrite first byte (key lenght) with 0 to mark as deleted
-	file.Write([]byte{1})
+	if valueReader != nil {
+		return valueReader(cursor.New(bytes.NewReader(value), 0, int64(len(value))))
+	}
 
-	return nil
+	return value, nil
 }
 
-func scanFile(ctx context.Context, file *os.File, readValues bool, callback func(key string, value []byte, deleted bool, filePosition int64)) error {
-	for {
+// Write encoded item at the given position (end of file) and return the item size
+func insertItemToFile(file io.WriterAt, itemPosition int64, it item) (int64, error) {
+	// create itemBytes from itemHeader and keyValue bytes
+	itemHeader := encodeItemHeader(it)
+	itemBytes := make([]byte, 0, len(itemHeader)+len(it.key)+len(it.value))
+	itemBytes = append(itemBytes, itemHeader...)
+	itemBytes = append(itemBytes, it.key...)
+	itemBytes = append(itemBytes, it.value...)
+
+	_, err := file.WriteAt(itemBytes, itemPosition)
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(len(itemBytes)), nil
+}
+
+// Scan the items of a file starting from the given position,
+// stops with *CorruptionError on the first corrupted item
+func scanFile(ctx context.Context, view dataView, position int64, callback func(item)) error {
+	for position < view.size {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
 		default:
-			currentPosition, err := file.Seek(0, io.SeekCurrent)
-			if err != nil {
-				return err
-			}
+		}
 
-			itemHeader := make([]byte, itemHeaderLenght)
+		header, err := readItemHeader(view.reader, position, view.size, view.version)
+		if err != nil {
+			return asCorruption(err, view, position)
+		}
 
-			n, err := file.Read(itemHeader)
-			if err != nil {
-				if n == 0 {
-					return nil
-				} else {
-					return err
-				}
-			}
+		itemBytes := make([]byte, header.keyLenght+header.valueLenght)
+		_, err = view.reader.ReadAt(itemBytes, position+header.size)
+		if err != nil {
+			return asCorruption(err, view, position)
+		}
+
+		key, value := itemBytes[:header.keyLenght], itemBytes[header.keyLenght:]
+		nextPosition := position + header.itemSize()
+
+		if view.version >= 2 && !header.valid(key, value) {
+			return &CorruptionError{Path: view.name, Offset: position, Reason: "checksum mismatch", next: nextPosition}
+		}
+
+		callback(item{key: string(key), value: value, flags: header.flags, codec: header.codec, expiresAt: header.expiresAt, sequence: header.sequence, deleted: header.deleted, position: position, size: header.itemSize(), patchOffset: header.patchOffset})
+
+		position = nextPosition
+	}
+
+	return nil
+}
 
-			keyLenght := uint(itemHeader[0])
-			valueLenght := binary.LittleEndian.Uint16(itemHeader[1:4])
-			isDeletedFlag := uint(itemHeader[4])
-			key := make([]byte, keyLenght)
-			value := make([]byte, valueLenght)
+// Scan file items and handle corrupted items according to the corruption policy
+func scanFileWithPolicy(ctx context.Context, file *os.File, version uint16, position int64, opts *options, callback func(item)) error {
+	view, err := fileView(file, version)
+	if err != nil {
+		return err
+	}
 
-			_, err = file.Read(key)
+	for {
+		err := scanFile(ctx, view, position, callback)
+
+		var corruption *CorruptionError
+		if !errors.As(err, &corruption) || opts.corruptionPolicy == FailOnCorruption {
+			return err
+		}
+
+		opts.corruptionReporter(corruption)
+
+		next := corruption.next
+		if next < 0 && opts.corruptionPolicy == SkipCorrupted {
+			next, err = findNextItem(ctx, view, corruption.Offset)
 			if err != nil {
 				return err
 			}
+		}
 
-			if readValues {
-				_, err = file.Read(value)
-				if err != nil {
-					return err
-				}
+		// The file is truncated only when no valid item follows the corrupted item
+		if opts.corruptionPolicy == TruncateCorrupted || next < 0 {
+			// Read-only files are not changed, the items after the corrupted item are ignored
+			if opts.readOnly {
+				return nil
 			}
 
-			callback(string(key), value, isDeletedFlag == 1, currentPosition)
+			return file.Truncate(corruption.Offset)
+		}
 
-			if !readValues {
-				_, err = file.Seek(int64(valueLenght), io.SeekCurrent)
-				if err != nil {
-					return err
-				}
-			}
+		position = next
+	}
+}
+
+// Find the first item after the corrupted item at position that is complete and matches its checksum,
+// returns -1 when there is none
+func findNextItem(ctx context.Context, view dataView, position int64) (int64, error) {
+	// Items of files without checksums can't be told apart from corrupted bytes
+	if view.version < 2 {
+		return -1, nil
+	}
+
+	buf := make([]byte, streamBufferLenght)
+	for position++; position < view.size; position++ {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+
+		header, err := readItemHeader(view.reader, position, view.size, view.version)
+		if err == nil && validItemAt(view, position, header, buf) {
+			return position, nil
 		}
 	}
+
+	return -1, nil
+}
+
+// Check the item at position against its checksum, the key and value are read in chunks of buf
+func validItemAt(view dataView, position int64, header itemHeader, buf []byte) bool {
+	crc := crc32.Update(0, crcTable, header.checksummed)
+
+	lenght := header.keyLenght + header.valueLenght
+	body := cursor.New(view.reader, position+header.size, lenght)
+	for offset := int64(0); offset < lenght; {
+		n, err := body.ReadAt(buf, offset)
+		if n == 0 || (err != nil && err != io.EOF) {
+			return false
+		}
+
+		crc = crc32.Update(crc, crcTable, buf[:n])
+		offset += int64(n)
+	}
+
+	return crc == header.checksum
+}
+
+// Convert item decoding errors and unexpected end of file into corruption error
+func asCorruption(err error, view dataView, itemPosition int64) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = errIncompleteItem
+	}
+
+	if err == errIncompleteItem || err == errInvalidItemHeader {
+		return &CorruptionError{Path: view.name, Offset: itemPosition, Reason: err.Error(), next: -1}
+	}
+
+	return err
 }
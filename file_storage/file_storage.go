@@ -1,73 +1,144 @@
-// Package filestore provide thraed-safe interface for storing key value pairs on a single file
-// the package includes automatic deleted keys cleanup when the number of deleted
-// keys become more then 30% of the total count.
+// Package filestore provide thraed-safe interface for storing key value pairs on segmented data files
+// the package includes automatic deleted keys cleanup when the deleted items
+// become more then 30% of a segment size.
 package filestore
 
 import (
+	"bytes"
 	"context"
 	"fmt"
-	"io/fs"
-	"log"
 	"os"
 	"sync"
+	"time"
 
-	"github.com/lokidb/engine/cursor"
+	"github.com/lokidb/engine/v2/cursor"
 )
 
-const maxKeyLenght = 255
-const maxValueLenght = 16777214
-const itemHeaderLenght = 5
+const defaultMaxKeyLenght = 255
+const defaultMaxValueLenght = 16777214
+const defaultMaxSegmentSize = 64 << 20
 const filePermissions = 600
-const cleanupOnDeletedRatio = 0.3
-const minDeletedKeyForCleanup = 500
 const cleanFileExtension = ".clean"
+const defaultExpirySweepInterval = time.Minute
+
+// Location of the latest item of a key
+type indexEntry struct {
+	segment   uint32
+	position  int64
+	size      int64
+	expiresAt int64        // unix milliseconds, 0 for keys that never expire
+	version   uint64       // sequence number of the latest write of the key
+	fragments []indexEntry // fragment items appended to the value, in append order
+
+	valueLenght int64 // lenght of the whole value, 0 when it is not known without reading the value
+}
 
 type FileKeyValueStore struct {
-	filePath        string
-	keysIndex       map[string]int64
-	deletedKeyCount int
-	lock            sync.Mutex
+	filePath    string
+	keysIndex   map[string]indexEntry
+	segments    []*segment // sorted by id, the last segment is the active segment
+	sequence    uint64     // sequence number of the latest write
+	options     options
+	hintExists  bool
+	syncer      *groupSyncer
+	stopSync    chan struct{}
+	stopSweep   chan struct{}
+	snapshots   map[*Snapshot]struct{} // open snapshots
+	lock        sync.Mutex
+	handlesLock sync.RWMutex // guards the segments handles for syncing without lock
 }
 
-func New(filePath string) *FileKeyValueStore {
+func New(filePath string, opts ...Option) (*FileKeyValueStore, error) {
 	fs := new(FileKeyValueStore)
 	fs.filePath = filePath
+	fs.options = defaultOptions()
 
-	ctx := context.Background()
-	keysIndex, deletedKeysCount, err := createKeysIndex(ctx, filePath)
-	if err != nil {
-		panic(err)
+	for _, opt := range opts {
+		opt(&fs.options)
 	}
 
-	fs.deletedKeyCount = deletedKeysCount
-	fs.keysIndex = *keysIndex
+	if fs.options.syncPolicy == SyncInterval && fs.options.syncInterval <= 0 {
+		return nil, fmt.Errorf("sync interval must be positive")
+	}
 
-	return fs
-}
+	if fs.options.compressionCodec != NoCompression {
+		if _, err := getCodec(fs.options.compressionCodec); err != nil {
+			return nil, err
+		}
+	}
 
-func openOrCreate(filePath string) *os.File {
-	file, err := os.OpenFile(filePath, os.O_RDWR, os.FileMode(filePermissions))
+	ids, err := listSegments(filePath)
 	if err != nil {
-		file, err = os.Create(filePath)
+		return nil, err
 	}
 
-	if err != nil {
-		panic(err)
+	ctx := context.Background()
+	for _, id := range ids {
+		path := segmentPath(filePath, id)
+
+		if !fs.options.readOnly {
+			if err := recoverInterruptedRewrite(path); err != nil {
+				return nil, err
+			}
+		}
+
+		version, err := prepareFile(ctx, path, &fs.options)
+		if err != nil {
+			return nil, err
+		}
+
+		fs.segments = append(fs.segments, &segment{id: id, path: path, version: version})
+	}
+
+	// Use the hint file when valid, and fallback to full scan of the segments
+	keysIndex, err := loadHintFile(filePath, fs.segments, &fs.options)
+	if err == nil {
+		fs.hintExists = true
+	} else {
+		if !fs.options.readOnly {
+			os.Remove(hintPath(filePath))
+		}
+
+		keysIndex, err = createKeysIndex(ctx, fs.segments, &fs.options)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	fs.keysIndex = keysIndex
+	for _, seg := range fs.segments {
+		if seg.sequence > fs.sequence {
+			fs.sequence = seg.sequence
+		}
+	}
+
+	if err = fs.openHandles(); err != nil {
+		return nil, err
 	}
 
-	return file
+	fs.syncer = newGroupSyncer(fs.syncWriter)
+	if fs.options.syncPolicy == SyncInterval && !fs.options.readOnly {
+		fs.startSyncLoop()
+	}
+
+	if fs.options.expirySweepInterval > 0 && !fs.options.readOnly {
+		fs.startExpirySweeper()
+	}
+
+	return fs, nil
 }
 
-func (fst *FileKeyValueStore) openOrPanic() *os.File {
-	file, err := os.OpenFile(fst.filePath, os.O_RDWR, fs.FileMode(filePermissions))
+func openOrCreate(filePath string) (*os.File, error) {
+	file, err := os.OpenFile(filePath, os.O_RDWR, os.FileMode(filePermissions))
 	if err != nil {
-		log.Panic(err)
+		file, err = os.Create(filePath)
 	}
 
-	return file
+	return file, err
 }
 
-// Returning value of key stored on file, or file cursor when valueReader is not nil
+// Returning value of key stored on file, or file cursor when valueReader is not nil,
+// returns ErrNotFound when the key does not exist
 func (fs *FileKeyValueStore) Get(key string, valueReader func(cursor.Cursor) ([]byte, error)) ([]byte, error) {
 	fs.lock.Lock()
 	defer fs.lock.Unlock()
@@ -77,119 +148,147 @@ func (fs *FileKeyValueStore) Get(key string, valueReader func(cursor.Cursor) ([]
 
 func (fs *FileKeyValueStore) iGet(key string, valueReader func(cursor.Cursor) ([]byte, error)) ([]byte, error) {
 	// Validate key
-	err := isValidKey(key)
+	err := isValidKey(key, fs.options.maxKeyLenght)
 	if err != nil {
 		return nil, err
 	}
 
+	if err := fs.checkUsable(); err != nil {
+		return nil, err
+	}
+
 	// Find item position from the index
-	itemPosition, exists := fs.keysIndex[key]
+	entry, exists := fs.liveEntry(key)
 
 	if !exists {
-		return nil, nil
+		return nil, ErrNotFound
 	}
 
-	file := fs.openOrPanic()
-	defer file.Close()
+	return fs.readEntry(entry, valueReader)
+}
 
-	return getValueFromPosition(file, itemPosition, nil)
+// Read the value of the index entry, or apply valueReader on it when it is not nil
+func (fs *FileKeyValueStore) readEntry(entry indexEntry, valueReader func(cursor.Cursor) ([]byte, error)) ([]byte, error) {
+	if len(entry.fragments) > 0 {
+		value, err := fs.readValue(entry)
+		if err != nil || valueReader == nil {
+			return value, err
+		}
+
+		return valueReader(cursor.New(bytes.NewReader(value), 0, int64(len(value))))
+	}
+
+	view, err := fs.readView(fs.segment(entry.segment))
+	if err != nil {
+		return nil, err
+	}
+
+	return getValueFromPosition(view, entry.position, fs.options.keyProvider, valueReader)
 }
 
 func (fs *FileKeyValueStore) Set(key string, value []byte) error {
 	fs.lock.Lock()
-	defer fs.lock.Unlock()
 
-	err, deletedItem := fs.iSet(key, value)
+	err, replaced := fs.iSet(key, value)
 
-	if deletedItem && fs.isCleanupRequired() {
-		ctx := context.Background()
-		go fs.cleanUp(ctx)
+	if replaced && fs.NeedsCompaction() {
+		fs.requestCompaction()
 	}
 
-	return err
+	seq := fs.syncer.lastWrite()
+	fs.lock.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	return fs.waitDurable(seq)
 }
 
-// Save key value in file
+// Append key value to the active segment, the previous item of the key becomes dead
 func (fs *FileKeyValueStore) iSet(key string, value []byte) (error, bool) {
+	return fs.iSetWithExpiry(key, value, 0)
+}
+
+// Append key value that expires at expiresAt unix milliseconds, or never when expiresAt is 0
+func (fs *FileKeyValueStore) iSetWithExpiry(key string, value []byte, expiresAt int64) (error, bool) {
 	// Validate key
-	err := isValidKey(key)
+	err := isValidKey(key, fs.options.maxKeyLenght)
 	if err != nil {
 		return err, false
 	}
 
 	// Validate value
-	err = isValidValue(value)
+	err = isValidValue(value, fs.options.maxValueLenght)
 	if err != nil {
 		return err, false
 	}
 
-	_, exists := fs.keysIndex[key]
-
-	deletedItem := false
-
-	if exists {
-		// TODO: check if its better to deleted every time or to check value and delete only on change
-		currentValue, err := fs.iGet(key, nil)
-
-		if err != nil {
-			return err, false
-		}
-
-		if equal(value, currentValue) {
-			return nil, false
-		} else {
-			err, deletedItem = fs.iDel(key)
-			if err != nil {
-				return err, deletedItem
-			}
-		}
+	if err := fs.checkUsable(); err != nil {
+		return err, false
 	}
 
-	file := fs.openOrPanic()
-	defer file.Close()
+	if fs.options.readOnly {
+		return ErrReadOnly, false
+	}
 
-	itemPosition, err := insertItemToFile(file, key, value)
-	if err == nil {
-		fs.keysIndex[key] = itemPosition
+	it, err := encodeItem(key, value, &fs.options)
+	if err != nil {
+		return err, false
 	}
+	it.setExpiry(expiresAt)
 
-	return err, deletedItem
+	replaced, err := fs.appendItem(key, it)
+	return err, replaced
 }
 
 func (fs *FileKeyValueStore) Del(key string) error {
 	fs.lock.Lock()
-	defer fs.lock.Unlock()
 
 	err, deletedItem := fs.iDel(key)
 
-	if deletedItem && fs.isCleanupRequired() {
-		ctx := context.Background()
-		go fs.cleanUp(ctx)
+	if deletedItem && fs.NeedsCompaction() {
+		fs.requestCompaction()
 	}
 
-	return err
+	seq := fs.syncer.lastWrite()
+	fs.lock.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	return fs.waitDurable(seq)
 }
 
-// Mark key value on file as deleted
+// Append tombstone of the key, the item of the key becomes dead
 func (fs *FileKeyValueStore) iDel(key string) (error, bool) {
 	// Validate key
-	err := isValidKey(key)
+	err := isValidKey(key, fs.options.maxKeyLenght)
 	if err != nil {
 		return err, false
 	}
 
+	if err := fs.checkUsable(); err != nil {
+		return err, false
+	}
+
 	// Get item position from index, if not found return error
-	itemPosition, exists := fs.keysIndex[key]
+	_, exists := fs.liveEntry(key)
 	if !exists {
-		return fmt.Errorf("key does not exists"), false
+		return ErrNotFound, false
 	}
 
-	delete(fs.keysIndex, key)
+	if fs.options.readOnly {
+		return ErrReadOnly, false
+	}
 
-	file := fs.openOrPanic()
-	defer file.Close()
+	tombstone, err := encodeTombstone(key, &fs.options)
+	if err != nil {
+		return err, false
+	}
 
-	err = markItemAsDeletedOnFile(file, itemPosition)
+	_, err = fs.appendItem(key, tombstone)
 	if err != nil {
 		return err, false
 	}
@@ -197,53 +296,241 @@ func (fs *FileKeyValueStore) iDel(key string) (error, bool) {
 	return nil, true
 }
 
+// Append item to the active segment with the next sequence number and update the index,
+// returns true when the item replaced an existing item of the key
+func (fs *FileKeyValueStore) appendItem(key string, it item) (bool, error) {
+	fs.invalidateHint()
+
+	if err := fs.rolloverIfFull(); err != nil {
+		return false, err
+	}
+
+	it.setSequence(fs.nextSequence())
+
+	active := fs.active()
+	itemSize, err := insertItemToFile(active.writer, active.size, it)
+	if err != nil {
+		return false, err
+	}
+
+	return fs.indexAppended(key, itemSize, it), nil
+}
+
+// Add the item written at the end of the active segment to the index, returns true when
+// the item replaced an existing item of the key
+func (fs *FileKeyValueStore) indexAppended(key string, itemSize int64, it item) bool {
+	active := fs.active()
+	entry := indexEntry{segment: active.id, position: active.size, size: itemSize, expiresAt: it.expiresAt, version: it.sequence, valueLenght: it.decodedLenght()}
+	active.size += itemSize
+	active.sequence = it.sequence
+	fs.syncer.write()
+
+	return indexItem(fs.keysIndex, fs.segments, key, entry, it)
+}
+
+// Update the index with item of the key at the location of entry, the previous items of the key
+// become dead unless the item is a fragment of them. Returns true when previous items became dead.
+func indexItem(keysIndex map[string]indexEntry, segments []*segment, key string, entry indexEntry, it item) bool {
+	previous, exists := keysIndex[key]
+
+	if it.fragment() {
+		if !exists {
+			// Fragment of a value that was replaced or deleted
+			markDead(segments, entry)
+			return false
+		}
+
+		// The fragments slice is never appended in place so copies of the entry are not changed
+		previous.fragments = append(previous.fragments[:len(previous.fragments):len(previous.fragments)], entry)
+		previous.version = entry.version
+		switch {
+		case previous.valueLenght == 0 || entry.valueLenght == 0:
+			previous.valueLenght = 0
+		case it.patch():
+			previous.valueLenght = max64(previous.valueLenght, it.patchOffset+entry.valueLenght)
+		default:
+			previous.valueLenght += entry.valueLenght
+		}
+		keysIndex[key] = previous
+		return false
+	}
+
+	if exists {
+		markDead(segments, previous)
+	}
+
+	if it.tombstone() {
+		delete(keysIndex, key)
+	} else {
+		keysIndex[key] = entry
+	}
+
+	return exists
+}
+
+// Keys of the store, expired keys are not included
 func (fs *FileKeyValueStore) Keys() []string {
 	fs.lock.Lock()
 	defer fs.lock.Unlock()
 
-	keys := make([]string, len(fs.keysIndex))
+	return liveKeys(fs.keysIndex, time.Now().UnixMilli())
+}
 
-	i := 0
-	for k := range fs.keysIndex {
-		keys[i] = k
-		i++
+// Keys of the index that are not expired at now unix milliseconds
+func liveKeys(keysIndex map[string]indexEntry, now int64) []string {
+	keys := make([]string, 0, len(keysIndex))
+
+	for k, entry := range keysIndex {
+		if !entry.expired(now) {
+			keys = append(keys, k)
+		}
 	}
 
 	return keys
 }
 
-func (fs *FileKeyValueStore) Flush() {
+// Delete all the segments and start with empty file, returns ErrSnapshotOpen while snapshots are open
+func (fs *FileKeyValueStore) Flush() error {
 	fs.lock.Lock()
 	defer fs.lock.Unlock()
 
-	fs.keysIndex = make(map[string]int64)
-	fs.deletedKeyCount = 0
+	if err := fs.checkUsable(); err != nil {
+		return err
+	}
 
-	os.Remove(fs.filePath)
+	if fs.options.readOnly {
+		return ErrReadOnly
+	}
+
+	// Snapshots read the items of the segments
+	if len(fs.snapshots) > 0 {
+		return ErrSnapshotOpen
+	}
+
+	fs.keysIndex = make(map[string]indexEntry)
+
+	fs.invalidateHint()
+	fs.closeHandles()
+	for _, seg := range fs.segments {
+		os.Remove(seg.path)
+	}
+
+	fs.handlesLock.Lock()
+	fs.segments = []*segment{{id: 0, path: fs.filePath, version: currentFormatVersion, sequence: fs.sequence}}
+	fs.handlesLock.Unlock()
 
 	// Recrete empty file
-	file, _ := os.Create(fs.filePath)
+	file, err := os.Create(fs.filePath)
+	if err != nil {
+		return err
+	}
+
+	// Sequence numbers continue after the flush so versions of deleted keys are not reused
+	header := newFileHeader(&fs.options)
+	header.sequence = fs.sequence
+	err = writeFileHeader(file, header)
 	file.Close()
+	if err != nil {
+		return err
+	}
+
+	return fs.openHandles()
 }
 
 func (fs *FileKeyValueStore) Search(ctx context.Context, evaluate func(value []byte) bool) ([][]byte, error) {
 	fs.lock.Lock()
 	defer fs.lock.Unlock()
 
-	file := openOrCreate(fs.filePath)
-	defer file.Close()
+	if err := fs.checkUsable(); err != nil {
+		return nil, err
+	}
+
+	return fs.search(ctx, fs.keysIndex, time.Now().UnixMilli(), evaluate)
+}
 
+// Scan the segments for the values of the keys index that are not expired at now unix milliseconds
+func (fs *FileKeyValueStore) search(ctx context.Context, keysIndex map[string]indexEntry, now int64, evaluate func(value []byte) bool) ([][]byte, error) {
 	results := make([][]byte, 0, 1000)
 
-	err := scanFile(ctx, file, true, func(key string, value []byte, deleted bool, filePosition int64) {
-		if evaluate(value) {
-			results = append(results, value)
+	for _, seg := range fs.segments {
+		view, err := fs.readView(seg)
+		if err != nil {
+			return nil, err
 		}
-	})
 
-	if err != nil {
-		return nil, err
+		var decodeErr error
+		err = scanFile(ctx, view, itemsOffset(seg.version), func(it item) {
+			if decodeErr != nil || it.tombstone() || it.fragment() {
+				return
+			}
+
+			// Skip items that were replaced or deleted by later items
+			key, err := decodeItemKey(it, fs.options.keyProvider)
+			if err != nil {
+				decodeErr = err
+				return
+			}
+
+			entry, exists := keysIndex[key]
+			if !exists || entry.segment != seg.id || entry.position != it.position || entry.expired(now) {
+				return
+			}
+
+			value, err := decodeItemValue(it, fs.options.keyProvider)
+			if len(entry.fragments) > 0 {
+				value, err = fs.readValue(entry)
+			}
+
+			if err != nil {
+				decodeErr = err
+				return
+			}
+
+			if evaluate(value) {
+				results = append(results, value)
+			}
+		})
+
+		if err == nil {
+			err = decodeErr
+		}
+
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	return results, nil
 }
+
+// Write hint file so the next open doesn't need to scan the data file and release the file handles
+func (fs *FileKeyValueStore) Close() error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	if fs.closed() {
+		return ErrClosed
+	}
+
+	if fs.stopSync != nil {
+		close(fs.stopSync)
+		fs.stopSync = nil
+	}
+
+	if fs.stopSweep != nil {
+		close(fs.stopSweep)
+		fs.stopSweep = nil
+	}
+
+	// The hint is not written after a failed sync, the index may have writes that are not on disk
+	var hintErr error
+	if !fs.options.readOnly && fs.syncer.failure() == nil {
+		hintErr = fs.writeHint()
+	}
+
+	if err := fs.closeHandles(); err != nil {
+		return err
+	}
+
+	return hintErr
+}
@@ -1,20 +1,32 @@
 package filestore
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"io"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
+
+	"github.com/lokidb/engine/v2/cursor"
+	"github.com/lokidb/engine/v2/encryption"
 )
 
 func TestFullUse(t *testing.T) {
 	t.Cleanup(func() {
 		os.Remove("./testfile")
+		os.Remove("./testfile.hint")
 	})
 
-	db := New("./testfile")
+	db, err := New("./testfile")
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	db.Set("a", []byte{97})
 
@@ -32,21 +44,38 @@ func TestFullUse(t *testing.T) {
 	}
 
 	value, err = db.Get("a", nil)
-	if err != nil {
-		t.Fatal(err)
+	if !errors.Is(err, ErrNotFound) || value != nil {
+		t.Errorf("expected ErrNotFound for deleted key not %v", err)
+	}
+
+	if err = db.Del("a"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound for deleting missing key not %v", err)
 	}
 
-	if value != nil {
-		t.Errorf("expected nil return for deleted key")
+	if err = db.Set("", []byte{97}); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("expected ErrInvalidKey for empty key not %v", err)
+	}
+
+	if err = db.Set("a", make([]byte, defaultMaxValueLenght+1)); !errors.Is(err, ErrValueTooLarge) {
+		t.Errorf("expected ErrValueTooLarge not %v", err)
+	}
+
+	db.Close()
+	if _, err = db.Get("a", nil); !errors.Is(err, ErrClosed) {
+		t.Errorf("expected ErrClosed after close not %v", err)
 	}
 }
 
 func TestCleanup(t *testing.T) {
 	t.Cleanup(func() {
 		os.Remove("./testfile5.test")
+		os.Remove("./testfile5.test.hint")
 	})
 
-	db := New("./testfile5.test")
+	db, err := New("./testfile5.test")
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	for i := 0; i < 1000; i++ {
 		err := db.Set(strconv.Itoa(i), []byte{45, 84})
@@ -79,7 +108,10 @@ func TestKeys(t *testing.T) {
 		os.Remove("./testfile8.test")
 	})
 
-	db := New("./testfile8.test")
+	db, err := New("./testfile8.test")
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	for i := 0; i < 1000; i++ {
 		err := db.Set(strconv.Itoa(i), []byte{45, 84})
@@ -96,7 +128,10 @@ func TestKeys(t *testing.T) {
 }
 
 func TestFlush(t *testing.T) {
-	db := New("./testfile.test")
+	db, err := New("./testfile.test")
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	for i := 0; i < 1000; i++ {
 		err := db.Set(strconv.Itoa(i), []byte{45, 84})
@@ -113,7 +148,7 @@ func TestFlush(t *testing.T) {
 		t.Error("expecting length of keys index to be 0 after flush")
 	}
 
-	if db.deletedKeyCount > 0 {
+	if db.deletedKeyCount() > 0 {
 		t.Error("expecting deleted keys count to be 0 after flush")
 	}
 }
@@ -123,7 +158,10 @@ func TestSearch(t *testing.T) {
 		os.Remove("./testfile.test")
 	})
 
-	db := New("./testfile.test")
+	db, err := New("./testfile.test")
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	for i := 0; i < 231; i++ {
 		err := db.Set(strconv.Itoa(i), []byte{byte(i), 84})
@@ -150,13 +188,16 @@ func TestSearch(t *testing.T) {
 }
 
 func TestFlushKeepFile(t *testing.T) {
-	db := New("./testfile2.test")
+	db, err := New("./testfile2.test")
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	db.Set("abc", []byte("asdassdasd"))
 
 	db.Flush()
 
-	err := os.Remove("./testfile2.test")
+	err = os.Remove("./testfile2.test")
 	if err != nil {
 		t.Error("expecting the file to exist after flush")
 	}
@@ -167,7 +208,10 @@ func TestThreadSafe(t *testing.T) {
 		os.Remove("./testfile3.test")
 	})
 
-	db := New("./testfile3.test")
+	db, err := New("./testfile3.test")
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	var wg sync.WaitGroup
 
@@ -196,3 +240,1921 @@ func TestThreadSafe(t *testing.T) {
 
 	wg.Wait()
 }
+
+func TestLegacyFileMigration(t *testing.T) {
+	t.Cleanup(func() {
+		os.Remove("./testfile9.test")
+	})
+
+	// Headerless file with item "a" -> "bc" and deleted item "d" -> "e"
+	legacy := []byte{1, 2, 0, 0, 0, 'a', 'b', 'c', 1, 1, 0, 0, 1, 'd', 'e'}
+	if err := os.WriteFile("./testfile9.test", legacy, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := New("./testfile9.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value, err := db.Get("a", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(value) != "bc" {
+		t.Errorf("expecting migrated value to be 'bc' not %s", value)
+	}
+
+	if len(db.Keys()) != 1 {
+		t.Error("expecting deleted legacy items to be dropped")
+	}
+
+	file, err := os.Open("./testfile9.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	header, err := readFileHeader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if header.version != currentFormatVersion {
+		t.Errorf("expecting file to be migrated to version %d not %d", currentFormatVersion, header.version)
+	}
+}
+
+func TestRejectUnknownFiles(t *testing.T) {
+	t.Cleanup(func() {
+		os.Remove("./testfile10.test")
+	})
+
+	if err := os.WriteFile("./testfile10.test", []byte("not a lokidb file at all"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := defaultOptions()
+	_, err := prepareFile(context.Background(), "./testfile10.test", &opts)
+	if !errors.Is(err, ErrNotLokiFile) {
+		t.Errorf("expecting ErrNotLokiFile not %v", err)
+	}
+
+	header := fileHeader{version: currentFormatVersion + 1}
+	if err = os.WriteFile("./testfile10.test", header.encode(), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = prepareFile(context.Background(), "./testfile10.test", &opts)
+	if !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("expecting ErrUnsupportedVersion not %v", err)
+	}
+}
+
+func TestCorruptionPolicies(t *testing.T) {
+	t.Cleanup(func() {
+		os.Remove("./testfile11.test")
+		os.Remove("./testfile35.test")
+		os.Remove("./testfile35.test.hint")
+	})
+
+	db, err := New("./testfile11.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.Set("a", []byte("aaaa"))
+	db.Set("b", []byte("bbbb"))
+	db.Set("c", []byte("cccc"))
+
+	// Flip a byte inside the value of "b"
+	file, err := os.OpenFile("./testfile11.test", os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bPosition := db.keysIndex["b"].position
+	file.WriteAt([]byte("x"), db.keysIndex["c"].position-1)
+	file.Close()
+
+	if _, err = db.Get("b", nil); !errors.As(err, new(*CorruptionError)) {
+		t.Errorf("expecting corruption error on get not %v", err)
+	}
+
+	if _, err = New("./testfile11.test"); !errors.As(err, new(*CorruptionError)) || !errors.Is(err, ErrCorrupted) {
+		t.Errorf("expecting corruption error on open not %v", err)
+	}
+
+	reported := 0
+	db, err = New("./testfile11.test", WithCorruptionPolicy(SkipCorrupted), WithCorruptionReporter(func(*CorruptionError) {
+		reported++
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reported != 1 || len(db.Keys()) != 2 {
+		t.Errorf("expecting only the corrupted item to be skipped")
+	}
+
+	db, err = New("./testfile11.test", WithCorruptionPolicy(TruncateCorrupted), WithCorruptionReporter(func(*CorruptionError) {}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(db.Keys()) != 1 {
+		t.Errorf("expecting all items from the corrupted item to be truncated")
+	}
+
+	fileInfo, err := os.Stat("./testfile11.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fileInfo.Size() != bPosition {
+		t.Errorf("expecting file to be truncated to %d not %d", bPosition, fileInfo.Size())
+	}
+
+	// Items after an item with broken value lenght are found by their checksums
+	db, err = New("./testfile35.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.Set("a", []byte("aaaa"))
+	db.Set("b", []byte("bbbb"))
+	db.Set("c", []byte("cccc"))
+	db.Set("d", []byte("dddd"))
+	positions := map[string]int64{"b": db.keysIndex["b"].position, "d": db.keysIndex["d"].position}
+	db.Close()
+
+	// The value lenght follows checksum, flags, codec, sequence and key lenght
+	file, err = os.OpenFile("./testfile35.test", os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file.WriteAt([]byte{0x7f}, positions["b"]+checksumLenght+2+sequenceLenght+1)
+	file.Close()
+	os.Remove("./testfile35.test.hint")
+
+	db, err = New("./testfile35.test", WithCorruptionPolicy(SkipCorrupted), WithCorruptionReporter(func(*CorruptionError) {}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if keys := db.Keys(); len(keys) != 3 {
+		t.Errorf("expecting only the item with broken lenght to be skipped, got keys %v", keys)
+	}
+
+	if value, _ := db.Get("c", nil); string(value) != "cccc" {
+		t.Errorf("expecting value 'cccc' after the skipped item not %s", value)
+	}
+	db.Close()
+
+	// Broken lenght at the end of the file is truncated
+	file, err = os.OpenFile("./testfile35.test", os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file.WriteAt([]byte{0x7f}, positions["d"]+checksumLenght+2+sequenceLenght+1)
+	file.Close()
+	os.Remove("./testfile35.test.hint")
+
+	db, err = New("./testfile35.test", WithCorruptionPolicy(SkipCorrupted), WithCorruptionReporter(func(*CorruptionError) {}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	if fileInfo, _ = os.Stat("./testfile35.test"); fileInfo.Size() != positions["d"] {
+		t.Errorf("expecting file to be truncated to %d not %d", positions["d"], fileInfo.Size())
+	}
+}
+
+func TestLargeItems(t *testing.T) {
+	t.Cleanup(func() {
+		os.Remove("./testfile12.test")
+	})
+
+	db, err := New("./testfile12.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	longKey := strings.Repeat("k", 1000)
+	if err = db.Set(longKey, []byte("v")); err == nil {
+		t.Error("expecting key longer then the default limit to be rejected")
+	}
+
+	db, err = New("./testfile12.test", WithMaxKeyLenght(2048), WithMaxValueLenght(1<<22))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	largeValue := bytes.Repeat([]byte("0123456789"), 300000)
+	if err = db.Set(longKey, largeValue); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = New("./testfile12.test", WithMaxKeyLenght(2048), WithMaxValueLenght(1<<22))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value, err := db.Get(longKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(value, largeValue) {
+		t.Error("expecting large value to be loaded from file")
+	}
+}
+
+func TestHintFile(t *testing.T) {
+	t.Cleanup(func() {
+		os.Remove("./testfile13.test")
+		os.Remove("./testfile13.test.hint")
+	})
+
+	db, err := New("./testfile13.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100; i++ {
+		db.Set(strconv.Itoa(i), []byte{byte(i)})
+	}
+	db.Del("5")
+
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = os.Stat("./testfile13.test.hint"); err != nil {
+		t.Fatal("expecting hint file to be written on close")
+	}
+
+	db, err = New("./testfile13.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !db.hintExists || len(db.Keys()) != 99 || db.deletedKeyCount() != 1 {
+		t.Error("expecting keys index to be loaded from hint file")
+	}
+
+	value, err := db.Get("50", nil)
+	if err != nil || value[0] != 50 {
+		t.Errorf("expecting value of key 50 to be loaded using the hint")
+	}
+
+	db.Set("100", []byte{100})
+
+	if _, err = os.Stat("./testfile13.test.hint"); !os.IsNotExist(err) {
+		t.Error("expecting hint file to be removed on mutation")
+	}
+
+	// Hint that doesn't match the data file must be ignored
+	db.Close()
+
+	file, err := os.OpenFile("./testfile13.test", os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileInfo, err := file.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = insertItemToFile(file, fileInfo.Size(), item{key: "101", value: []byte{101}}); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	db, err = New("./testfile13.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if db.hintExists || len(db.Keys()) != 101 {
+		t.Error("expecting stale hint file to be ignored")
+	}
+}
+
+func TestMmapReads(t *testing.T) {
+	t.Cleanup(func() {
+		os.Remove("./testfile14.test")
+		os.Remove("./testfile14.test.hint")
+	})
+
+	db, err := New("./testfile14.test", WithMmap(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100; i++ {
+		db.Set(strconv.Itoa(i), []byte{byte(i), 1})
+
+		value, err := db.Get(strconv.Itoa(i), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if value[0] != byte(i) {
+			t.Fatalf("expecting value of key %d to be read after remap", i)
+		}
+	}
+
+	for i := 0; i < 50; i++ {
+		db.Del(strconv.Itoa(i))
+	}
+
+	if err = db.cleanUp(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	value, err := db.Get("75", nil)
+	if err != nil || value[0] != 75 {
+		t.Errorf("expecting value to be read from the mapping of the cleaned file")
+	}
+
+	value, err = db.Get("75", func(c cursor.Cursor) ([]byte, error) {
+		c.Seek(1, io.SeekStart)
+		return io.ReadAll(c)
+	})
+	if err != nil || len(value) != 1 || value[0] != 1 {
+		t.Errorf("expecting cursor to read the end of the value not %v", value)
+	}
+
+	searchResults, err := db.Search(context.Background(), func(value []byte) bool {
+		return value[0] >= 90
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(searchResults) != 10 {
+		t.Errorf("expecting 10 search results not %d", len(searchResults))
+	}
+
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClose(t *testing.T) {
+	t.Cleanup(func() {
+		os.Remove("./testfile15.test")
+		os.Remove("./testfile15.test.hint")
+	})
+
+	db, err := New("./testfile15.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.Set("a", []byte("1"))
+	db.Set("a", []byte("2"))
+
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if db.segments[0].reader != nil || db.segments[0].writer != nil {
+		t.Error("expecting file handles to be released on close")
+	}
+
+	if err = db.Set("b", []byte("1")); !errors.Is(err, ErrClosed) {
+		t.Errorf("expecting ErrClosed on set after close not %v", err)
+	}
+
+	if _, err = db.Get("a", nil); !errors.Is(err, ErrClosed) {
+		t.Errorf("expecting ErrClosed on get after close not %v", err)
+	}
+
+	db, err = New("./testfile15.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value, err := db.Get("a", nil)
+	if err != nil || string(value) != "2" {
+		t.Errorf("expecting overwritten value to be '2' not %s", value)
+	}
+
+	db.Close()
+}
+
+func TestRecoverInterruptedCompaction(t *testing.T) {
+	t.Cleanup(func() {
+		os.Remove("./testfile16.test")
+		os.Remove("./testfile16.test.hint")
+		os.Remove("./testfile16.test.clean")
+	})
+
+	db, err := New("./testfile16.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.Set("a", []byte("1"))
+	db.Close()
+
+	// Compaction crashed before the rename, the partial clean file must be discarded
+	if err = os.WriteFile("./testfile16.test.clean", []byte("partial"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = New("./testfile16.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	if _, err = os.Stat("./testfile16.test.clean"); !os.IsNotExist(err) {
+		t.Error("expecting stray clean file to be removed")
+	}
+
+	// Original was removed but the clean file was not renamed yet
+	if err = os.Rename("./testfile16.test", "./testfile16.test.clean"); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = New("./testfile16.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	value, err := db.Get("a", nil)
+	if err != nil || string(value) != "1" {
+		t.Error("expecting clean file to be recovered as the data file")
+	}
+}
+
+type reverseCodec struct{}
+
+func (reverseCodec) ID() byte {
+	return 200
+}
+
+func (reverseCodec) Compress(value []byte) ([]byte, error) {
+	compressed := make([]byte, len(value)-1)
+	for i := range compressed {
+		compressed[i] = value[len(value)-2-i]
+	}
+	return compressed, nil
+}
+
+func (reverseCodec) Decompress(data []byte) ([]byte, error) {
+	value := make([]byte, len(data)+1)
+	for i := range data {
+		value[len(data)-1-i] = data[i]
+	}
+	value[len(data)] = '!'
+	return value, nil
+}
+
+func TestCompression(t *testing.T) {
+	t.Cleanup(func() {
+		os.Remove("./testfile17.test")
+		os.Remove("./testfile17.test.hint")
+	})
+
+	db, err := New("./testfile17.test", WithCompression(GzipCodec, 64))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	largeValue := bytes.Repeat([]byte(`{"name": "loki", "type": "json"}`), 300)
+	db.Set("large", largeValue)
+	db.Set("small", []byte("small"))
+
+	if db.active().size > int64(len(largeValue)/5) {
+		t.Errorf("expecting large value to be stored compressed, file size is %d", db.active().size)
+	}
+
+	value, err := db.Get("large", nil)
+	if err != nil || !bytes.Equal(value, largeValue) {
+		t.Error("expecting compressed value to be decoded on get")
+	}
+
+	part, err := db.Get("large", func(c cursor.Cursor) ([]byte, error) {
+		part := make([]byte, 6)
+		_, err := c.ReadAt(part, 2)
+		return part, err
+	})
+	if err != nil || string(part) != "name\":" {
+		t.Errorf("expecting cursor to read the decoded value not %s", part)
+	}
+
+	if err = db.Patch("large", 2, []byte("NAME")); err != nil {
+		t.Fatal(err)
+	}
+
+	if value, _ = db.Get("large", nil); !bytes.HasPrefix(value, []byte(`{"NAME"`)) || len(value) != len(largeValue) {
+		t.Error("expecting compressed value to be patched by copy on write")
+	}
+	db.Patch("large", 2, []byte("name"))
+
+	results, err := db.Search(context.Background(), func(value []byte) bool {
+		return bytes.HasPrefix(value, []byte(`{"name"`))
+	})
+	if err != nil || len(results) != 1 {
+		t.Error("expecting search to match the decoded value")
+	}
+	db.Close()
+
+	// Files with mixed codecs stay readable with another codec
+	if _, err = getCodec(200); err != nil {
+		if err = RegisterCodec(reverseCodec{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db, err = New("./testfile17.test", WithCompression(200, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Set("custom", []byte("abc!"))
+
+	value, err = db.Get("custom", nil)
+	if err != nil || string(value) != "abc!" {
+		t.Errorf("expecting custom codec to decode value not %s", value)
+	}
+
+	value, err = db.Get("large", nil)
+	if err != nil || !bytes.Equal(value, largeValue) {
+		t.Error("expecting gzip value to be readable after codec change")
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	t.Cleanup(func() {
+		os.Remove("./testfile18.test")
+		os.Remove("./testfile18.test.hint")
+		os.Remove("./testfile33.test")
+		os.Remove("./testfile33.test.hint")
+	})
+
+	keyRing, err := encryption.NewKeyRing(1, bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := New("./testfile18.test", WithEncryption(keyRing, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.Set("secret-key", []byte("secret-value"))
+	db.Set("other-key", []byte("other-value"))
+
+	value, err := db.Get("secret-key", nil)
+	if err != nil || string(value) != "secret-value" {
+		t.Errorf("expecting to decrypt the value, got %s %v", value, err)
+	}
+
+	results, err := db.Search(context.Background(), func(value []byte) bool {
+		return bytes.HasPrefix(value, []byte("secret"))
+	})
+	if err != nil || len(results) != 1 {
+		t.Error("expecting search to match the decrypted value")
+	}
+
+	if len(db.Keys()) != 2 {
+		t.Error("expecting keys to be listed")
+	}
+	db.Close()
+
+	for _, path := range []string{"./testfile18.test", "./testfile18.test.hint"} {
+		content, _ := os.ReadFile(path)
+		if bytes.Contains(content, []byte("secret")) {
+			t.Errorf("expecting %s to not contain plaintext", path)
+		}
+	}
+
+	// Rotate the key, old items are readable and encrypted again with the new key
+	keyRing.Rotate(2, bytes.Repeat([]byte{2}, 32))
+	db, err = New("./testfile18.test", WithEncryption(keyRing, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value, err = db.Get("secret-key", nil)
+	if err != nil || string(value) != "secret-value" {
+		t.Error("expecting to decrypt values encrypted with the previous key")
+	}
+
+	if err = db.Reencrypt(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	newKeyRing, _ := encryption.NewKeyRing(2, bytes.Repeat([]byte{2}, 32))
+	db, err = New("./testfile18.test", WithEncryption(newKeyRing, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value, err = db.Get("other-key", nil)
+	if err != nil || string(value) != "other-value" {
+		t.Error("expecting values to be encrypted with the current key after reencrypt")
+	}
+	db.Close()
+
+	_, err = New("./testfile18.test")
+	if !errors.Is(err, ErrMissingKeyProvider) {
+		t.Errorf("expecting missing key provider error not %v", err)
+	}
+
+	file, err := os.Open("./testfile18.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	header, err := readFileHeader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if header.flags != fileEncryptedValuesFlag|fileEncryptedKeysFlag {
+		t.Errorf("expecting header flags to record the encryption options not %d", header.flags)
+	}
+
+	// The keys index of the hint doesn't need the key provider when only values are encrypted
+	db, err = New("./testfile33.test", WithEncryption(keyRing, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Set("secret-key", []byte("secret-value"))
+	db.Close()
+
+	if _, err = New("./testfile33.test"); !errors.Is(err, ErrMissingKeyProvider) {
+		t.Errorf("expecting missing key provider error with hint not %v", err)
+	}
+}
+
+func TestSyncPolicies(t *testing.T) {
+	t.Cleanup(func() {
+		os.Remove("./testfile19.test")
+		os.Remove("./testfile19.test.hint")
+	})
+
+	if _, err := New("./testfile19.test", WithSyncPolicy(SyncInterval, 0)); err == nil {
+		t.Error("expecting error for sync interval without interval")
+	}
+
+	db, err := New("./testfile19.test", WithSyncPolicy(SyncAlways, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Slow sync so concurrent writers have to wait for it and join the next sync
+	var syncs int32
+	var syncsLock sync.Mutex
+	db.syncer.syncFile = func() error {
+		syncsLock.Lock()
+		syncs++
+		syncsLock.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		return db.syncWriter()
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := db.Set(strconv.Itoa(i), []byte("value")); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if syncs == 0 || syncs > 10 {
+		t.Errorf("expecting concurrent writes to be synced together, got %d syncs for 50 writes", syncs)
+	}
+
+	if !db.syncer.isSynced() {
+		t.Error("expecting all the writes to be synced when set returns")
+	}
+	db.Close()
+
+	db, err = New("./testfile19.test", WithSyncPolicy(SyncInterval, 5*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Del("1")
+
+	for i := 0; i < 100 && !db.syncer.isSynced(); i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if !db.syncer.isSynced() {
+		t.Error("expecting writes to be synced in the background")
+	}
+}
+
+func TestSyncFailure(t *testing.T) {
+	errSync := errors.New("sync failed")
+	failing := false
+	g := newGroupSyncer(func() error {
+		if failing {
+			return errSync
+		}
+		return nil
+	})
+
+	synced := g.write()
+	if err := g.wait(synced); err != nil {
+		t.Fatal(err)
+	}
+
+	failed := g.write()
+	failing = true
+	if err := g.wait(failed); !errors.Is(err, errSync) {
+		t.Errorf("expecting sync error not %v", err)
+	}
+
+	// The failure is sticky even when the next sync succeeds
+	failing = false
+	if err := g.wait(failed); !errors.Is(err, errSync) {
+		t.Errorf("expecting sync error for the failed write not %v", err)
+	}
+
+	if err := g.wait(g.write()); !errors.Is(err, errSync) {
+		t.Errorf("expecting sync error for later writes not %v", err)
+	}
+
+	if err := g.wait(synced); err != nil {
+		t.Errorf("expecting writes synced before the failure to succeed not %v", err)
+	}
+
+	// The store can't be used after a failed sync
+	t.Cleanup(func() {
+		os.Remove("./testfile34.test")
+		os.Remove("./testfile34.test.hint")
+	})
+
+	db, err := New("./testfile34.test", WithSyncPolicy(SyncAlways, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.Set("key", []byte("value"))
+	db.syncer.syncFile = func() error {
+		return errSync
+	}
+
+	if err = db.Set("key", []byte("failed")); !errors.Is(err, errSync) {
+		t.Errorf("expecting sync error not %v", err)
+	}
+
+	if _, err = db.Get("key", nil); !errors.Is(err, errSync) {
+		t.Errorf("expecting reads to fail after a failed sync not %v", err)
+	}
+
+	size := db.active().size
+	if err = db.Set("other", []byte("value")); !errors.Is(err, errSync) || db.active().size != size {
+		t.Errorf("expecting writes to be rejected after a failed sync, got %v", err)
+	}
+	db.Close()
+
+	if _, err = os.Stat("./testfile34.test.hint"); !os.IsNotExist(err) {
+		t.Error("expecting no hint after a failed sync")
+	}
+}
+
+func TestSegments(t *testing.T) {
+	t.Cleanup(func() {
+		segments, _ := filepath.Glob("./testfile20.test*")
+		for _, path := range segments {
+			os.Remove(path)
+		}
+	})
+
+	db, err := New("./testfile20.test", WithMaxSegmentSize(512), WithCompactionPolicy(CompactionPolicy{MinDeadRatio: 0.5}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value := bytes.Repeat([]byte("v"), 20)
+	for i := 0; i < 100; i++ {
+		db.Set(strconv.Itoa(i), value)
+	}
+
+	if len(db.segments) < 4 {
+		t.Fatalf("expecting data to be split into segments, got %d segments", len(db.segments))
+	}
+
+	if _, err = os.Stat("./testfile20.test.000001"); err != nil {
+		t.Error("expecting segment file to be created next to the store file")
+	}
+
+	for i, seg := range db.segments {
+		if seg.size > 512+64 {
+			t.Errorf("expecting segment %d to be capped not %d bytes", seg.id, seg.size)
+		}
+
+		if (seg.writer != nil) != (i == len(db.segments)-1) {
+			t.Errorf("expecting only the active segment to keep a write handle, segment %d", seg.id)
+		}
+	}
+
+	// Delete the keys of the first segment only, compaction must not rewrite the other segments
+	first := db.segments[0]
+	for key, entry := range db.keysIndex {
+		if entry.segment == first.id {
+			db.Del(key)
+		}
+	}
+
+	secondSize := db.segments[1].size
+	if err = db.Compact(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if first.size != fileHeaderLenght || first.deadBytes != 0 {
+		t.Error("expecting the first segment to be compacted")
+	}
+
+	if db.segments[1].size != secondSize {
+		t.Error("expecting segments without deleted items to be kept as is")
+	}
+
+	keysCount := len(db.Keys())
+	db.Close()
+
+	// Reopen with the hint file and with full scan of the segments
+	for _, useHint := range []bool{true, false} {
+		if !useHint {
+			os.Remove("./testfile20.test.hint")
+		}
+
+		db, err = New("./testfile20.test", WithMaxSegmentSize(512))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if db.hintExists != useHint || len(db.Keys()) != keysCount {
+			t.Errorf("expecting %d keys after reopen not %d", keysCount, len(db.Keys()))
+		}
+
+		got, err := db.Get("99", nil)
+		if err != nil || !bytes.Equal(got, value) {
+			t.Error("expecting value from the last segment")
+		}
+
+		results, err := db.Search(context.Background(), func([]byte) bool { return true })
+		if err != nil || len(results) < keysCount {
+			t.Error("expecting search to scan all the segments")
+		}
+
+		db.Close()
+	}
+
+	db, err = New("./testfile20.test", WithMaxSegmentSize(512))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Flush()
+
+	if _, err = os.Stat("./testfile20.test.000001"); !os.IsNotExist(err) || len(db.segments) != 1 {
+		t.Error("expecting flush to remove the segments")
+	}
+}
+
+func TestTombstones(t *testing.T) {
+	t.Cleanup(func() {
+		segments, _ := filepath.Glob("./testfile21.test*")
+		for _, path := range segments {
+			os.Remove(path)
+		}
+	})
+
+	db, err := New("./testfile21.test", WithMaxSegmentSize(256))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.Set("a", []byte("1"))
+	db.Set("b", []byte("1"))
+	db.Set("b", []byte("2"))
+
+	before, _ := os.ReadFile("./testfile21.test")
+	db.Del("a")
+	after, _ := os.ReadFile("./testfile21.test")
+
+	if len(after) <= len(before) || !bytes.Equal(after[:len(before)], before) {
+		t.Error("expecting delete to append tombstone without changing written items")
+	}
+
+	// Fill the first segment so the next items go to new segments
+	for i := 0; i < 20; i++ {
+		db.Set(strconv.Itoa(i), bytes.Repeat([]byte("v"), 20))
+	}
+	db.Del("b")
+	db.Set("a", []byte("3"))
+
+	results, err := db.Search(context.Background(), func([]byte) bool { return true })
+	if err != nil || len(results) != 21 {
+		t.Errorf("expecting search to return only the latest values, got %d results", len(results))
+	}
+
+	// Compact the segments after the first, the tombstone of b must survive
+	// while the first segment still has its dead item
+	for _, seg := range db.segments[1:] {
+		if err = db.rewriteSegment(context.Background(), seg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+	os.Remove("./testfile21.test.hint")
+
+	db, err = New("./testfile21.test", WithMaxSegmentSize(256))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if value, _ := db.Get("b", nil); value != nil {
+		t.Error("expecting tombstone to hide deleted key after replay")
+	}
+
+	if value, _ := db.Get("a", nil); string(value) != "3" {
+		t.Errorf("expecting last write of key a to win not %s", value)
+	}
+
+	if err = db.cleanUp(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, seg := range db.segments {
+		if seg.deadBytes != 0 {
+			t.Error("expecting all dead items to be removed")
+		}
+	}
+	db.Close()
+	os.Remove("./testfile21.test.hint")
+
+	db, err = New("./testfile21.test", WithMaxSegmentSize(256))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if value, _ := db.Get("b", nil); value != nil || len(db.Keys()) != 21 {
+		t.Error("expecting deleted key to stay deleted after compaction")
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	t.Cleanup(func() {
+		files, _ := filepath.Glob("./testfile22.test*")
+		for _, path := range files {
+			os.Remove(path)
+		}
+		os.Remove("./testfile23.test")
+	})
+
+	if _, err := New("./testfile22.test", WithReadOnly(true)); err == nil {
+		t.Error("expecting read-only open of missing file to fail")
+	}
+
+	db, err := New("./testfile22.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Set("a", []byte("1"))
+	db.Set("b", []byte("2"))
+	db.Del("b")
+	db.Close()
+
+	before, _ := os.ReadFile("./testfile22.test")
+	files, _ := filepath.Glob("./testfile22.test*")
+
+	db, err = New("./testfile22.test", WithReadOnly(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if value, _ := db.Get("a", nil); string(value) != "1" {
+		t.Errorf("expecting value '1' not %s", value)
+	}
+
+	if err = db.Set("c", []byte("3")); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("expecting Set to return ErrReadOnly not %v", err)
+	}
+
+	if err = db.Del("a"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("expecting Del to return ErrReadOnly not %v", err)
+	}
+
+	if err = db.Flush(); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("expecting Flush to return ErrReadOnly not %v", err)
+	}
+
+	if err = db.Compact(context.Background()); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("expecting Compact to return ErrReadOnly not %v", err)
+	}
+	db.Close()
+
+	after, _ := os.ReadFile("./testfile22.test")
+	afterFiles, _ := filepath.Glob("./testfile22.test*")
+	if !bytes.Equal(before, after) || len(files) != len(afterFiles) {
+		t.Error("expecting read-only store to leave the files unchanged")
+	}
+
+	// Legacy files are read without migration
+	legacy := []byte{1, 2, 0, 0, 0, 'a', 'b', 'c', 1, 1, 0, 0, 1, 'd', 'e'}
+	if err = os.WriteFile("./testfile23.test", legacy, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = New("./testfile23.test", WithReadOnly(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if value, _ := db.Get("a", nil); string(value) != "bc" || len(db.Keys()) != 1 {
+		t.Errorf("expecting legacy value 'bc' not %s", value)
+	}
+	db.Close()
+
+	if after, _ = os.ReadFile("./testfile23.test"); !bytes.Equal(legacy, after) {
+		t.Error("expecting legacy file not to be migrated")
+	}
+}
+
+func TestStreaming(t *testing.T) {
+	t.Cleanup(func() {
+		os.Remove("./testfile24.test")
+		os.Remove("./testfile24.test.hint")
+	})
+
+	db, err := New("./testfile24.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	value := make([]byte, 3*streamBufferLenght+100)
+	for i := range value {
+		value[i] = byte(i % 251)
+	}
+
+	if err = db.SetReader("big", bytes.NewReader(value), int64(len(value))); err != nil {
+		t.Fatal(err)
+	}
+
+	if stored, err := db.Get("big", nil); err != nil || !bytes.Equal(stored, value) {
+		t.Errorf("expecting streamed value to be stored, got error %v", err)
+	}
+
+	var buf bytes.Buffer
+	if n, err := db.GetTo("big", &buf); err != nil || n != int64(len(value)) || !bytes.Equal(buf.Bytes(), value) {
+		t.Errorf("expecting GetTo to write the value, got %d bytes and error %v", n, err)
+	}
+
+	reader, err := db.Open("big")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The opened value stays readable after the key is replaced and the segment compacted
+	db.Set("big", []byte("small"))
+	if err = db.cleanUp(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	part := make([]byte, 10)
+	if _, err = reader.Seek(-10, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = io.ReadFull(reader, part); err != nil || !bytes.Equal(part, value[len(value)-10:]) {
+		t.Errorf("expecting to read the end of the opened value, got error %v", err)
+	}
+	reader.Close()
+
+	// Short reader leaves no partial item
+	sizeBefore := db.active().size
+	err = db.SetReader("short", bytes.NewReader(value[:100]), 200)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("expecting io.ErrUnexpectedEOF not %v", err)
+	}
+
+	fileInfo, _ := os.Stat("./testfile24.test")
+	if fileInfo.Size() != sizeBefore {
+		t.Error("expecting partly written item to be removed")
+	}
+
+	if _, err = db.Get("short", nil); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expecting short value not to be stored, got %v", err)
+	}
+
+	if err = db.SetReader("big", bytes.NewReader(value), int64(len(value))); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.OpenFile("./testfile24.test", os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteAt([]byte{0}, db.keysIndex["big"].position+db.keysIndex["big"].size-1)
+	file.Close()
+
+	if _, err = db.GetTo("big", io.Discard); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("expecting GetTo to detect corrupted value not %v", err)
+	}
+}
+
+func TestPatch(t *testing.T) {
+	t.Cleanup(func() {
+		files, _ := filepath.Glob("./testfile25.test*")
+		for _, path := range files {
+			os.Remove(path)
+		}
+	})
+
+	db, err := New("./testfile25.test", WithMaxSegmentSize(1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value := bytes.Repeat([]byte("0123456789"), 20000)
+	db.Set("first", []byte("abcdef"))
+	db.Set("big", value)
+	db.Set("last", []byte("z"))
+	db.Close()
+
+	db, err = New("./testfile25.test", WithMaxSegmentSize(1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Patches are appended, the sealed segments are not changed
+	sealedSizes := make(map[string]int64)
+	for _, seg := range db.segments[:len(db.segments)-1] {
+		fileInfo, _ := os.Stat(seg.path)
+		sealedSizes[seg.path] = fileInfo.Size()
+	}
+
+	if err = db.Patch("big", 100000, []byte("HELLO")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.Patch("first", 1, []byte("BC")); err != nil {
+		t.Fatal(err)
+	}
+
+	for path, size := range sealedSizes {
+		if fileInfo, _ := os.Stat(path); fileInfo.Size() != size {
+			t.Errorf("expecting sealed segment %s not to change", path)
+		}
+	}
+
+	// Patches that fit in a value of the active segment are written in place
+	active := db.active()
+	activeSize := active.size
+	version, _ := db.Version("last")
+	if err = db.Patch("last", 0, []byte("y")); err != nil {
+		t.Fatal(err)
+	}
+
+	if fileInfo, _ := os.Stat(active.path); active.size != activeSize || fileInfo.Size() != activeSize {
+		t.Error("expecting patch in place of the active segment")
+	}
+
+	if patchedVersion, _ := db.Version("last"); patchedVersion <= version {
+		t.Errorf("expecting version after patch in place to be greater than %d not %d", version, patchedVersion)
+	}
+
+	// Items read by open snapshots are not patched in place
+	snap, _ := db.Snapshot()
+	db.Patch("last", 0, []byte("w"))
+	if stored, _ := snap.Get("last", nil); string(stored) != "y" {
+		t.Errorf("expecting snapshot value 'y' not %s", stored)
+	}
+	snap.Release()
+
+	if active.size == activeSize {
+		t.Error("expecting patch item while a snapshot is open")
+	}
+
+	db.Patch("last", 0, []byte("y"))
+
+	expected := append([]byte{}, value...)
+	copy(expected[100000:], "HELLO")
+	if stored, _ := db.Get("big", nil); !bytes.Equal(stored, expected) {
+		t.Error("expecting patched value")
+	}
+
+	// Patches beyond the end of the value extend the value
+	if err = db.Patch("first", 4, []byte("EFGH")); err != nil {
+		t.Fatal(err)
+	}
+
+	if stored, _ := db.Get("first", nil); string(stored) != "aBCdEFGH" {
+		t.Errorf("expecting extended value 'aBCdEFGH' not %s", stored)
+	}
+
+	if err = db.Patch("first", 20, []byte("x")); !errors.Is(err, ErrInvalidValue) {
+		t.Errorf("expecting ErrInvalidValue for patch beyond the value not %v", err)
+	}
+
+	if err = db.Patch("missing", 0, []byte("x")); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expecting ErrNotFound not %v", err)
+	}
+
+	// Patches and appends are applied in order
+	db.Append("first", []byte("!"))
+	db.Patch("first", 8, []byte("?"))
+	db.Close()
+
+	for _, withHint := range []bool{true, false} {
+		if !withHint {
+			os.Remove("./testfile25.test.hint")
+		}
+
+		db, err = New("./testfile25.test", WithMaxSegmentSize(1024))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if stored, err := db.Get("big", nil); err != nil || !bytes.Equal(stored, expected) {
+			t.Errorf("expecting patched value after reopen, got error %v", err)
+		}
+
+		if stored, _ := db.Get("first", nil); string(stored) != "aBCdEFGH?" {
+			t.Errorf("expecting value 'aBCdEFGH?' after reopen not %s", stored)
+		}
+
+		if stored, _ := db.Get("last", nil); string(stored) != "y" {
+			t.Errorf("expecting value 'y' after reopen not %s", stored)
+		}
+		db.Close()
+	}
+
+	// Compaction merges the patches with the value
+	db, err = New("./testfile25.test", WithMaxSegmentSize(1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, seg := range db.segments {
+		if err = db.rewriteSegment(context.Background(), seg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if stored, _ := db.Get("big", nil); !bytes.Equal(stored, expected) {
+		t.Error("expecting patched value after compaction")
+	}
+
+	if stored, _ := db.Get("first", nil); string(stored) != "aBCdEFGH?" {
+		t.Errorf("expecting value 'aBCdEFGH?' after compaction not %s", stored)
+	}
+}
+
+func TestAppend(t *testing.T) {
+	t.Cleanup(func() {
+		files, _ := filepath.Glob("./testfile26.test*")
+		for _, path := range files {
+			os.Remove(path)
+		}
+	})
+
+	db, err := New("./testfile26.test", WithMaxSegmentSize(2048))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Concurrent appends to the same key are not lost, long chains are merged on the way
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if err := db.Append("events", []byte("x")); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if value, _ := db.Get("events", nil); string(value) != strings.Repeat("x", 500) {
+		t.Errorf("expecting 500 appended bytes, got %d", len(value))
+	}
+
+	db.Set("log", []byte("a"))
+	for _, part := range []string{"b", "c", "d"} {
+		db.Append("log", []byte(part))
+	}
+
+	if value, _ := db.Get("log", nil); string(value) != "abcd" {
+		t.Errorf("expecting appended value 'abcd' not %s", value)
+	}
+
+	results, _ := db.Search(context.Background(), func(value []byte) bool { return value[0] == 'a' })
+	if len(results) != 1 || string(results[0]) != "abcd" {
+		t.Error("expecting search to evaluate the whole value")
+	}
+
+	var buf bytes.Buffer
+	if _, err = db.GetTo("log", &buf); err != nil || buf.String() != "abcd" {
+		t.Errorf("expecting GetTo to write the whole value, got %s", buf.String())
+	}
+
+	// Compaction of the first segment keeps the fragments in other segments in place
+	for i := 0; i < 50; i++ {
+		db.Set(strconv.Itoa(i), bytes.Repeat([]byte("v"), 20))
+	}
+	db.Append("log", []byte("e"))
+	db.Del("0")
+
+	for _, seg := range db.segments {
+		if err = db.rewriteSegment(context.Background(), seg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if value, _ := db.Get("log", nil); string(value) != "abcde" {
+		t.Errorf("expecting value 'abcde' after compaction not %s", value)
+	}
+	db.Close()
+
+	for _, withHint := range []bool{true, false} {
+		if !withHint {
+			os.Remove("./testfile26.test.hint")
+		}
+
+		db, err = New("./testfile26.test", WithMaxSegmentSize(2048))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if value, _ := db.Get("log", nil); string(value) != "abcde" {
+			t.Errorf("expecting value 'abcde' after reopen not %s", value)
+		}
+
+		if value, _ := db.Get("events", nil); len(value) != 500 {
+			t.Errorf("expecting 500 bytes after reopen not %d", len(value))
+		}
+		db.Close()
+	}
+
+	// The whole value is limited by the maximum value lenght, not only the appended data
+	db, err = New("./testfile26.test", WithMaxSegmentSize(2048), WithMaxValueLenght(501))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err = db.Append("events", []byte("xx")); !errors.Is(err, ErrValueTooLarge) {
+		t.Errorf("expecting ErrValueTooLarge not %v", err)
+	}
+
+	if err = db.Append("events", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.Append("events", []byte("x")); !errors.Is(err, ErrValueTooLarge) {
+		t.Errorf("expecting ErrValueTooLarge after append not %v", err)
+	}
+}
+
+func TestAppendMergedOnCompaction(t *testing.T) {
+	t.Cleanup(func() {
+		os.Remove("./testfile27.test")
+		os.Remove("./testfile27.test.hint")
+	})
+
+	db, err := New("./testfile27.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.Set("log", []byte("a"))
+	db.Append("log", []byte("b"))
+	db.Append("log", []byte("c"))
+	db.Set("other", []byte("1"))
+	db.Del("other")
+
+	if err = db.cleanUp(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(db.keysIndex["log"].fragments) != 0 {
+		t.Error("expecting fragments to be merged by compaction")
+	}
+
+	if value, _ := db.Get("log", nil); string(value) != "abc" {
+		t.Errorf("expecting merged value 'abc' not %s", value)
+	}
+
+	db.Set("log", []byte("new"))
+	if value, _ := db.Get("log", nil); string(value) != "new" {
+		t.Errorf("expecting set to replace the appended value not %s", value)
+	}
+	db.Close()
+	os.Remove("./testfile27.test.hint")
+
+	db, err = New("./testfile27.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if value, _ := db.Get("log", nil); string(value) != "new" {
+		t.Errorf("expecting value 'new' after replay not %s", value)
+	}
+}
+
+func TestTTL(t *testing.T) {
+	t.Cleanup(func() {
+		os.Remove("./testfile28.test")
+		os.Remove("./testfile28.test.hint")
+	})
+
+	db, err := New("./testfile28.test", WithExpirySweepInterval(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.SetWithTTL("session", []byte("a"), 0); !errors.Is(err, ErrInvalidTTL) {
+		t.Errorf("expecting ErrInvalidTTL for zero ttl, got %v", err)
+	}
+
+	db.SetWithTTL("session", []byte("a"), 200*time.Millisecond)
+	db.Append("session", []byte("b"))
+	db.Set("keep", []byte("value"))
+	db.Set("later", []byte("value"))
+	db.Expire("later", time.Hour)
+
+	if value, _ := db.Get("session", nil); string(value) != "ab" {
+		t.Errorf("expecting value 'ab' before expiry not %s", value)
+	}
+
+	if ttl, err := db.TTL("keep"); err != nil || ttl != 0 {
+		t.Errorf("expecting zero ttl for key without expiry, got %v %v", ttl, err)
+	}
+
+	// The expiry is kept in the hint and in the items header
+	for _, removeHint := range []bool{false, true} {
+		db.Close()
+		if removeHint {
+			os.Remove("./testfile28.test.hint")
+		}
+
+		db, err = New("./testfile28.test", WithExpirySweepInterval(0))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ttl, err := db.TTL("session"); err != nil || ttl <= 0 || ttl > 200*time.Millisecond {
+			t.Errorf("expecting ttl of up to 200ms after reopen, got %v %v", ttl, err)
+		}
+
+		if ttl, _ := db.TTL("later"); ttl <= 59*time.Minute {
+			t.Errorf("expecting ttl of about an hour after reopen, got %v", ttl)
+		}
+	}
+
+	time.Sleep(250 * time.Millisecond)
+
+	if _, err = db.Get("session", nil); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expecting ErrNotFound for expired key, got %v", err)
+	}
+
+	if _, err = db.TTL("session"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expecting ErrNotFound ttl for expired key, got %v", err)
+	}
+
+	if keys := db.Keys(); len(keys) != 2 {
+		t.Errorf("expecting expired key to be hidden from keys, got %v", keys)
+	}
+
+	results, _ := db.Search(context.Background(), func(value []byte) bool { return true })
+	if len(results) != 2 {
+		t.Errorf("expecting expired key to be hidden from search, got %d results", len(results))
+	}
+
+	// Compaction deletes the expired key from the file
+	if err = db.cleanUp(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, exists := db.keysIndex["session"]; exists {
+		t.Error("expecting expired key to be deleted by compaction")
+	}
+
+	db.Close()
+	os.Remove("./testfile28.test.hint")
+
+	db, err = New("./testfile28.test", WithExpirySweepInterval(20*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, exists := db.keysIndex["session"]; exists {
+		t.Error("expecting expired key to stay deleted after replay")
+	}
+
+	// The sweeper deletes expired keys in the background
+	db.SetWithTTL("short", []byte("value"), 10*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+
+	db.lock.Lock()
+	_, exists := db.keysIndex["short"]
+	db.lock.Unlock()
+
+	if exists {
+		t.Error("expecting expired key to be deleted by the sweeper")
+	}
+}
+
+func TestFormatUpgrade(t *testing.T) {
+	t.Cleanup(func() {
+		os.Remove("./testfile29.test")
+		os.Remove("./testfile29.test.hint")
+		os.Remove("./testfile29.test.encrypted")
+	})
+
+	// Items of a compatible version are valid items without sequence and expiry
+	file, err := os.Create("./testfile29.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFileHeader(file, fileHeader{version: compatibleFormatVersion})
+	insertItemToFile(file, fileHeaderLenght, item{key: "key", value: []byte("value")})
+	file.Close()
+
+	db, err := New("./testfile29.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if value, version, _ := db.GetWithVersion("key", nil); string(value) != "value" || version != 0 {
+		t.Errorf("expecting value of upgraded file without version, got %s %d", value, version)
+	}
+
+	if db.segments[0].version != currentFormatVersion {
+		t.Errorf("expecting upgraded file version %d not %d", currentFormatVersion, db.segments[0].version)
+	}
+
+	// Older files didn't record the encryption, it is taken from the items
+	file, err = os.Create("./testfile29.test.encrypted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFileHeader(file, fileHeader{version: compatibleFormatVersion})
+	insertItemToFile(file, fileHeaderLenght, item{key: "key", value: []byte("sealed"), flags: encryptedValueFlag})
+	file.Close()
+
+	if _, err = New("./testfile29.test.encrypted"); !errors.Is(err, ErrMissingKeyProvider) {
+		t.Errorf("expecting missing key provider error for upgraded encrypted file not %v", err)
+	}
+}
+
+func TestVersions(t *testing.T) {
+	t.Cleanup(func() {
+		os.Remove("./testfile30.test")
+		os.Remove("./testfile30.test.hint")
+	})
+
+	db, err := New("./testfile30.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	version, err := db.SetIfAbsent("key", []byte("a"))
+	if err != nil || version == 0 {
+		t.Fatalf("expecting version of new key, got %d %v", version, err)
+	}
+
+	if _, err = db.SetIfAbsent("key", []byte("b")); !errors.Is(err, ErrKeyExists) {
+		t.Errorf("expecting ErrKeyExists, got %v", err)
+	}
+
+	if _, err = db.SetIfExists("missing", []byte("b")); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expecting ErrNotFound, got %v", err)
+	}
+
+	swapped, err := db.CompareAndSwap("key", version, []byte("value"))
+	if err != nil || swapped <= version {
+		t.Errorf("expecting newer version after swap, got %d %v", swapped, err)
+	}
+
+	if _, err = db.CompareAndSwap("key", version, []byte("lost")); !errors.Is(err, ErrVersionMismatch) {
+		t.Errorf("expecting ErrVersionMismatch, got %v", err)
+	}
+
+	// Patches and appends change the version too
+	db.Patch("key", 0, []byte("V"))
+	_, patched, _ := db.GetWithVersion("key", nil)
+	db.Append("key", []byte("!"))
+	value, appended, _ := db.GetWithVersion("key", nil)
+
+	if patched <= swapped || appended <= patched || string(value) != "Value!" {
+		t.Errorf("expecting patch and append to change the version, got %d %d %s", patched, appended, value)
+	}
+
+	if err = db.DeleteIfVersion("key", patched); !errors.Is(err, ErrVersionMismatch) {
+		t.Errorf("expecting ErrVersionMismatch for delete, got %v", err)
+	}
+
+	db.Set("other", []byte("value"))
+	_, otherVersion, _ := db.GetWithVersion("other", nil)
+
+	// Versions are kept in the hint and in the items, also of deleted keys
+	for _, removeHint := range []bool{false, true} {
+		db.Close()
+		if removeHint {
+			os.Remove("./testfile30.test.hint")
+		}
+
+		db, err = New("./testfile30.test")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if value, version, _ := db.GetWithVersion("key", nil); version != appended || string(value) != "Value!" {
+			t.Errorf("expecting version %d after reopen, got %d %s", appended, version, value)
+		}
+	}
+
+	if err = db.DeleteIfVersion("other", otherVersion); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.cleanUp(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	os.Remove("./testfile30.test.hint")
+
+	db, err = New("./testfile30.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if version, _ = db.SetIfAbsent("other", []byte("value")); version <= otherVersion+1 {
+		t.Errorf("expecting versions of deleted key not to be reused, got %d", version)
+	}
+
+	// A crash after a patch must not bring back the version of the hint
+	db.Set("patched", []byte("value"))
+	db.Close()
+
+	db, err = New("./testfile30.test", WithExpirySweepInterval(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.Patch("patched", 0, []byte("V"))
+	_, patchedVersion, _ := db.GetWithVersion("patched", nil)
+	db.syncWriter()
+	db.closeHandles()
+
+	db, err = New("./testfile30.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if value, version, _ := db.GetWithVersion("patched", nil); version != patchedVersion || string(value) != "Value" {
+		t.Errorf("expecting version %d of the patch after a crash, got %d %s", patchedVersion, version, value)
+	}
+
+	// Concurrent read modify write with compare and swap
+	db.Set("counter", []byte("0"))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				value, version, _ := db.GetWithVersion("counter", nil)
+				n, _ := strconv.Atoi(string(value))
+				_, err := db.CompareAndSwap("counter", version, []byte(strconv.Itoa(n+1)))
+				if err == nil {
+					return
+				}
+
+				if !errors.Is(err, ErrVersionMismatch) {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if value, _ := db.Get("counter", nil); string(value) != "10" {
+		t.Errorf("expecting counter 10 not %s", value)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	t.Cleanup(func() {
+		os.Remove("./testfile31.test")
+		os.Remove("./testfile31.test.hint")
+	})
+
+	db, err := New("./testfile31.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err = db.CheckBatch([]BatchOp{{Key: "a", Value: []byte("1")}, {Key: "", Value: []byte("2")}}); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("expecting ErrInvalidKey for batch with empty key, got %v", err)
+	}
+
+	db.Set("old", []byte("value"))
+	ops := []BatchOp{
+		{Key: "a", Value: []byte("1")},
+		{Key: "a", Value: []byte("2")},
+		{Key: "old", Delete: true},
+		{Key: "missing", Delete: true},
+	}
+
+	// Applying the batch again gives the same result
+	for i := 0; i < 2; i++ {
+		if err = db.ApplyBatch(ops); err != nil {
+			t.Fatal(err)
+		}
+
+		if value, _ := db.Get("a", nil); string(value) != "2" {
+			t.Errorf("expecting the last write of the batch to win, got %s", value)
+		}
+
+		if _, err = db.Get("old", nil); !errors.Is(err, ErrNotFound) {
+			t.Errorf("expecting deleted key, got %v", err)
+		}
+	}
+
+	if err = db.ApplyBatch([]BatchOp{{Key: "b", Value: []byte("1")}, {Key: "c"}}); !errors.Is(err, ErrInvalidValue) {
+		t.Errorf("expecting ErrInvalidValue, got %v", err)
+	}
+
+	if _, err = db.Get("b", nil); !errors.Is(err, ErrNotFound) {
+		t.Error("expecting invalid batch not to be applied")
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	t.Cleanup(func() {
+		os.Remove("./testfile32.test")
+		os.Remove("./testfile32.test.hint")
+	})
+
+	db, err := New("./testfile32.test", WithCompactionTrigger(func(*FileKeyValueStore) {}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Set("a", []byte("1"))
+	db.Set("b", []byte("1"))
+	db.Append("b", []byte("2"))
+	db.SetWithTTL("session", []byte("1"), 50*time.Millisecond)
+
+	snap, err := db.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.Patch("a", 0, []byte("2"))
+	db.Append("b", []byte("3"))
+	db.Del("session")
+	db.Set("c", []byte("1"))
+
+	time.Sleep(100 * time.Millisecond)
+
+	// Superseded items are kept while the snapshot is open and the snapshot reads them at their new locations
+	if err = db.cleanUp(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if seg := db.segments[0]; seg.pinnedBytes == 0 || seg.deadBytes != seg.pinnedBytes {
+		t.Errorf("expecting only the items of the snapshot to be kept, dead bytes %d kept %d", seg.deadBytes, seg.pinnedBytes)
+	}
+
+	if db.NeedsCompaction() {
+		t.Error("expecting no compaction of the items kept for the snapshot")
+	}
+
+	if err = db.Reencrypt(context.Background()); err != nil {
+		t.Errorf("expecting rewrite while snapshot is open, got %v", err)
+	}
+
+	for key, expected := range map[string]string{"a": "1", "b": "12", "session": "1"} {
+		if value, err := snap.Get(key, nil); err != nil || string(value) != expected {
+			t.Errorf("expecting snapshot value %s of %s, got %s %v", expected, key, value, err)
+		}
+	}
+
+	if _, err = snap.Get("c", nil); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expecting key created after the snapshot not to be found, got %v", err)
+	}
+
+	if keys, _ := snap.Keys(); len(keys) != 3 {
+		t.Errorf("expecting 3 snapshot keys, got %v", keys)
+	}
+
+	results, _ := snap.Search(context.Background(), func(value []byte) bool { return true })
+	if len(results) != 3 {
+		t.Errorf("expecting 3 snapshot search results, got %d", len(results))
+	}
+
+	if value, _ := db.Get("a", nil); string(value) != "2" {
+		t.Errorf("expecting patched value 2 not %s", value)
+	}
+
+	if value, _ := db.Get("b", nil); string(value) != "123" {
+		t.Errorf("expecting appended value 123 not %s", value)
+	}
+
+	// Flush fails while the snapshot is open
+	if err = db.Flush(); !errors.Is(err, ErrSnapshotOpen) {
+		t.Errorf("expecting ErrSnapshotOpen, got %v", err)
+	}
+
+	if value, err := snap.Get("a", nil); err != nil || string(value) != "1" {
+		t.Errorf("expecting snapshot to be readable after the failed flush, got %s %v", value, err)
+	}
+
+	if err = snap.Release(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = snap.Get("a", nil); !errors.Is(err, ErrSnapshotReleased) {
+		t.Errorf("expecting ErrSnapshotReleased, got %v", err)
+	}
+
+	if err = db.cleanUp(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, seg := range db.segments {
+		if seg.deadBytes != 0 {
+			t.Error("expecting superseded items to be removed once the snapshot is released")
+		}
+	}
+
+	// Keys are hidden by the creation time of the snapshot
+	db.SetWithTTL("session", []byte("1"), time.Hour)
+	later, err := db.SnapshotAt(time.Now().Add(2 * time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = later.Get("session", nil); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expecting key expired at the snapshot time not to be found, got %v", err)
+	}
+	later.Release()
+
+	// Items kept for a snapshot don't come back after reopen
+	snap, _ = db.Snapshot()
+	db.Set("a", []byte("3"))
+	db.Del("c")
+	if err = db.cleanUp(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	os.Remove("./testfile32.test.hint")
+
+	db, err = New("./testfile32.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if value, _ := db.Get("a", nil); string(value) != "3" {
+		t.Errorf("expecting value 3 after reopen not %s", value)
+	}
+
+	if _, err = db.Get("c", nil); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expecting deleted key not to be found after reopen, got %v", err)
+	}
+}
@@ -0,0 +1,51 @@
+package filestore
+
+// Open the long lived read handles of all the segments and the append handle of the active segment,
+// items are read and written with positional I/O so the handles can be shared by all operations
+func (fs *FileKeyValueStore) openHandles() error {
+	fs.handlesLock.Lock()
+	defer fs.handlesLock.Unlock()
+
+	for i, seg := range fs.segments {
+		writable := i == len(fs.segments)-1 && !fs.options.readOnly
+		if err := seg.open(writable); err != nil {
+			for _, opened := range fs.segments[:i] {
+				opened.close()
+			}
+
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (fs *FileKeyValueStore) closeHandles() error {
+	// Wait for running sync of the writer before closing it
+	fs.handlesLock.Lock()
+	defer fs.handlesLock.Unlock()
+
+	var closeErr error
+	for _, seg := range fs.segments {
+		if err := seg.close(); err != nil && closeErr == nil {
+			closeErr = err
+		}
+	}
+
+	return closeErr
+}
+
+// Check if the handles were released by Close
+func (fs *FileKeyValueStore) closed() bool {
+	return fs.active().reader == nil
+}
+
+// Check the store can be used, a store can't be used once it is closed or after a failed sync
+// since it is unknown which of the writes reached the disk, the store has to be opened again
+func (fs *FileKeyValueStore) checkUsable() error {
+	if fs.closed() {
+		return ErrClosed
+	}
+
+	return fs.syncer.failure()
+}
@@ -0,0 +1,137 @@
+package filestore
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Every data file starts with a fixed size header:
+//
+//	magic (4 bytes) | format version (2 bytes) | creation flags (2 bytes) | sequence (8 bytes)
+//
+// followed by the items stream. The sequence is the highest sequence number written to the file before
+// it was created, so sequence numbers of items dropped by compaction are not reused.
+// The creation flags record the options the file was created with, items still carry their own
+// flags and codec so a file may hold items written with other options after a reopen.
+const fileMagic = "LOKI"
+const fileHeaderLenght = 16
+
+// Files written before the header was introduced are treated as version 0
+const legacyFormatVersion = 0
+const currentFormatVersion = 9
+
+// Items of files since this version are valid items of the current version,
+// only the file header of these files is updated
+const compatibleFormatVersion = 6
+
+// File creation flags
+const (
+	fileCompressedFlag uint16 = 1 << iota
+	fileEncryptedValuesFlag
+	fileEncryptedKeysFlag
+)
+
+var ErrNotLokiFile = errors.New("file is not a lokidb data file")
+var ErrUnsupportedVersion = errors.New("unsupported data file format version")
+
+type fileHeader struct {
+	version  uint16
+	flags    uint16
+	sequence uint64
+}
+
+func newFileHeader(opts *options) fileHeader {
+	header := fileHeader{version: currentFormatVersion}
+	if opts.compressionCodec != NoCompression {
+		header.flags |= fileCompressedFlag
+	}
+
+	if opts.keyProvider != nil {
+		header.flags |= fileEncryptedValuesFlag
+		if opts.encryptKeys {
+			header.flags |= fileEncryptedKeysFlag
+		}
+	}
+
+	return header
+}
+
+// Creation flags of a file that holds the item
+func itemFileFlags(it item) uint16 {
+	var flags uint16
+	if it.flags&encryptedValueFlag != 0 {
+		flags |= fileEncryptedValuesFlag
+	}
+
+	if it.flags&encryptedKeyFlag != 0 {
+		flags |= fileEncryptedKeysFlag
+	}
+
+	return flags
+}
+
+// Files created with encryption can't be read without a key provider
+func (h fileHeader) check(opts *options) error {
+	if h.flags&(fileEncryptedValuesFlag|fileEncryptedKeysFlag) != 0 && opts.keyProvider == nil {
+		return ErrMissingKeyProvider
+	}
+
+	return nil
+}
+
+func (h fileHeader) encode() []byte {
+	header := make([]byte, fileHeaderLenght)
+	copy(header, fileMagic)
+	binary.LittleEndian.PutUint16(header[4:6], h.version)
+	binary.LittleEndian.PutUint16(header[6:8], h.flags)
+	binary.LittleEndian.PutUint64(header[8:16], h.sequence)
+
+	return header
+}
+
+func writeFileHeader(file *os.File, header fileHeader) error {
+	_, err := file.WriteAt(header.encode(), 0)
+	return err
+}
+
+// Read the file header, files without the magic bytes are reported as legacy files
+func readFileHeader(file *os.File) (fileHeader, error) {
+	header := make([]byte, fileHeaderLenght)
+
+	_, err := file.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return fileHeader{}, err
+	}
+
+	if string(header[:len(fileMagic)]) != fileMagic {
+		return fileHeader{version: legacyFormatVersion}, nil
+	}
+
+	if err == io.EOF {
+		return fileHeader{}, fmt.Errorf("%w: truncated header", ErrNotLokiFile)
+	}
+
+	h := fileHeader{
+		version:  binary.LittleEndian.Uint16(header[4:6]),
+		flags:    binary.LittleEndian.Uint16(header[6:8]),
+		sequence: binary.LittleEndian.Uint64(header[8:16]),
+	}
+
+	if h.version > currentFormatVersion {
+		return fileHeader{}, fmt.Errorf("%w: %d", ErrUnsupportedVersion, h.version)
+	}
+
+	return h, nil
+}
+
+// Offset of the first item in a file with the given format version
+func itemsOffset(version uint16) int64 {
+	if version == legacyFormatVersion {
+		return 0
+	}
+
+	return fileHeaderLenght
+}
@@ -0,0 +1,254 @@
+package filestore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"github.com/lokidb/engine/v2/encryption"
+)
+
+// Hint file stores the keys index of a store so it can be loaded without scanning the segments.
+//
+//	magic (4 bytes) | version (2 bytes) | flags (2 bytes) | segments count (8 bytes)
+//	segments: id (uvarint) | size (uvarint) | deleted keys count (uvarint) | dead bytes (uvarint) | sequence (uvarint)
+//	entries: key lenght (uvarint) | key | segment id (uvarint) | item position (uvarint) | item size (uvarint) |
+//	         expiry (uvarint) | version (uvarint) | value lenght (uvarint) | fragments count (uvarint) |
+//	         fragments: segment id (uvarint) | item position (uvarint) | item size (uvarint)
+//	checksum of everything before (4 bytes)
+//
+// When the keys are encrypted the segments and entries are encrypted as a single block.
+// The hint is valid only while the segments are not modified, it is removed before the first
+// mutation and written again on compaction and on close.
+const hintFileExtension = ".hint"
+const hintMagic = "LOKH"
+const hintVersion = 7
+const hintHeaderLenght = 16
+const hintEncryptedFlag = 1
+
+var errStaleHint = errors.New("hint file does not match data file")
+
+func hintPath(filePath string) string {
+	return filePath + hintFileExtension
+}
+
+func writeHintFile(filePath string, segments []*segment, keysIndex map[string]indexEntry, opts *options) error {
+	header := make([]byte, hintHeaderLenght)
+	copy(header, hintMagic)
+	binary.LittleEndian.PutUint16(header[4:6], hintVersion)
+	binary.LittleEndian.PutUint64(header[8:16], uint64(len(segments)))
+
+	var body bytes.Buffer
+	varint := make([]byte, binary.MaxVarintLen64)
+	writeUvarint := func(v uint64) {
+		n := binary.PutUvarint(varint, v)
+		body.Write(varint[:n])
+	}
+
+	for _, seg := range segments {
+		writeUvarint(uint64(seg.id))
+		writeUvarint(uint64(seg.size))
+		writeUvarint(uint64(seg.deletedKeyCount))
+		writeUvarint(uint64(seg.deadBytes))
+		writeUvarint(seg.sequence)
+	}
+
+	for key, entry := range keysIndex {
+		writeUvarint(uint64(len(key)))
+		body.WriteString(key)
+		writeUvarint(uint64(entry.segment))
+		writeUvarint(uint64(entry.position))
+		writeUvarint(uint64(entry.size))
+		writeUvarint(uint64(entry.expiresAt))
+		writeUvarint(entry.version)
+		writeUvarint(uint64(entry.valueLenght))
+		writeUvarint(uint64(len(entry.fragments)))
+
+		for _, fragment := range entry.fragments {
+			writeUvarint(uint64(fragment.segment))
+			writeUvarint(uint64(fragment.position))
+			writeUvarint(uint64(fragment.size))
+		}
+	}
+
+	content := body.Bytes()
+	if opts.keyProvider != nil && opts.encryptKeys {
+		binary.LittleEndian.PutUint16(header[6:8], hintEncryptedFlag)
+
+		var err error
+		content, err = encryption.Seal(opts.keyProvider, content, header)
+		if err != nil {
+			return err
+		}
+	}
+
+	file, err := os.Create(hintPath(filePath))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	crc := crc32.New(crcTable)
+	writer := bufio.NewWriter(io.MultiWriter(file, crc))
+	writer.Write(header)
+	writer.Write(content)
+
+	if err = writer.Flush(); err != nil {
+		return err
+	}
+
+	if err = binary.Write(file, binary.LittleEndian, crc.Sum32()); err != nil {
+		return err
+	}
+
+	return file.Sync()
+}
+
+// Load keys index from the hint file and the deleted items statistics of the segments,
+// returns errStaleHint when the hint doesn't match the segments on disk
+func loadHintFile(filePath string, segments []*segment, opts *options) (map[string]indexEntry, error) {
+	content, err := os.ReadFile(hintPath(filePath))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(content) < hintHeaderLenght+checksumLenght || string(content[:len(hintMagic)]) != hintMagic {
+		return nil, errStaleHint
+	}
+
+	body, checksum := content[:len(content)-checksumLenght], content[len(content)-checksumLenght:]
+	if crc32.Checksum(body, crcTable) != binary.LittleEndian.Uint32(checksum) {
+		return nil, errStaleHint
+	}
+
+	if binary.LittleEndian.Uint16(body[4:6]) != hintVersion || binary.LittleEndian.Uint64(body[8:16]) != uint64(len(segments)) {
+		return nil, errStaleHint
+	}
+
+	entries := body[hintHeaderLenght:]
+	if binary.LittleEndian.Uint16(body[6:8])&hintEncryptedFlag != 0 {
+		if opts.keyProvider == nil {
+			return nil, ErrMissingKeyProvider
+		}
+
+		entries, err = encryption.Open(opts.keyProvider, entries, body[:hintHeaderLenght])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	reader := bytes.NewReader(entries)
+	readUvarints := func(values ...*uint64) error {
+		for _, v := range values {
+			if *v, err = binary.ReadUvarint(reader); err != nil {
+				return errStaleHint
+			}
+		}
+
+		return nil
+	}
+
+	segmentSizes := make(map[uint32]int64, len(segments))
+	for _, seg := range segments {
+		fileInfo, err := os.Stat(seg.path)
+		if err != nil {
+			return nil, err
+		}
+
+		var id, size, deletedKeyCount, deadBytes, sequence uint64
+		if err = readUvarints(&id, &size, &deletedKeyCount, &deadBytes, &sequence); err != nil {
+			return nil, err
+		}
+
+		if uint32(id) != seg.id || int64(size) != fileInfo.Size() {
+			return nil, errStaleHint
+		}
+
+		seg.deletedKeyCount = int(deletedKeyCount)
+		seg.deadBytes = int64(deadBytes)
+		seg.sequence = sequence
+		segmentSizes[seg.id] = fileInfo.Size()
+	}
+
+	keysIndex := make(map[string]indexEntry)
+	for reader.Len() > 0 {
+		keyLenght, err := binary.ReadUvarint(reader)
+		if err != nil || keyLenght > uint64(reader.Len()) {
+			return nil, errStaleHint
+		}
+
+		key := make([]byte, keyLenght)
+		reader.Read(key)
+
+		readEntry := func() (indexEntry, error) {
+			var segmentID, position, size uint64
+			if err := readUvarints(&segmentID, &position, &size); err != nil {
+				return indexEntry{}, err
+			}
+
+			segmentSize, exists := segmentSizes[uint32(segmentID)]
+			if !exists || position+size > uint64(segmentSize) {
+				return indexEntry{}, errStaleHint
+			}
+
+			return indexEntry{segment: uint32(segmentID), position: int64(position), size: int64(size)}, nil
+		}
+
+		entry, err := readEntry()
+		if err != nil {
+			return nil, err
+		}
+
+		var expiresAt, version, valueLenght, fragmentsCount uint64
+		if err = readUvarints(&expiresAt, &version, &valueLenght, &fragmentsCount); err != nil || fragmentsCount > uint64(reader.Len()) {
+			return nil, errStaleHint
+		}
+		entry.expiresAt = int64(expiresAt)
+		entry.version = version
+		entry.valueLenght = int64(valueLenght)
+
+		for i := uint64(0); i < fragmentsCount; i++ {
+			fragment, err := readEntry()
+			if err != nil {
+				return nil, err
+			}
+
+			entry.fragments = append(entry.fragments, fragment)
+		}
+
+		keysIndex[string(key)] = entry
+	}
+
+	return keysIndex, nil
+}
+
+// Remove the hint file before the data file is modified
+func (fs *FileKeyValueStore) invalidateHint() {
+	if !fs.hintExists {
+		return
+	}
+
+	os.Remove(hintPath(fs.filePath))
+	fs.hintExists = false
+}
+
+// Write the hint file of the current keys index, the segments are synced first
+// so the hint never describes items that are not on disk
+func (fs *FileKeyValueStore) writeHint() error {
+	if err := fs.syncWriter(); err != nil {
+		return err
+	}
+
+	if err := writeHintFile(fs.filePath, fs.segments, fs.keysIndex, &fs.options); err != nil {
+		os.Remove(hintPath(fs.filePath))
+		return err
+	}
+
+	fs.hintExists = true
+
+	return nil
+}
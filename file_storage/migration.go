@@ -0,0 +1,179 @@
+package filestore
+
+import (
+	"context"
+	"fmt"
+	"os"
+)
+
+const migrationFileExtension = ".migrate"
+
+// Make sure the file exists and is written in the current format version and return the version,
+// empty files get a fresh header and older files are rewritten in place.
+// In read-only mode the file must exist and is used in its own format version.
+// The creation flags of every file are checked against the options, also when the keys index is loaded from the hint.
+func prepareFile(ctx context.Context, filePath string, opts *options) (uint16, error) {
+	if opts.readOnly {
+		return readFileVersion(filePath, opts)
+	}
+
+	file, err := openOrCreate(filePath)
+	if err != nil {
+		return 0, err
+	}
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return 0, err
+	}
+
+	if fileInfo.Size() == 0 {
+		err = writeFileHeader(file, newFileHeader(opts))
+		file.Close()
+		return currentFormatVersion, err
+	}
+
+	header, err := readFileHeader(file)
+	file.Close()
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", filePath, err)
+	}
+
+	switch {
+	case header.version == currentFormatVersion:
+	case header.version >= compatibleFormatVersion:
+		err = upgradeFileHeader(ctx, filePath, header)
+	default:
+		err = migrateFile(ctx, filePath, header)
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	// Upgraded files are checked with the flags of their items
+	return readFileVersion(filePath, opts)
+}
+
+// Update the header of a compatible file, files of older versions didn't write creation flags
+// so the flags are taken from the encryption of the items
+func upgradeFileHeader(ctx context.Context, filePath string, header fileHeader) error {
+	file, err := os.OpenFile(filePath, os.O_RDWR, os.FileMode(filePermissions))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	view, err := fileView(file, header.version)
+	if err != nil {
+		return err
+	}
+
+	// Corrupted items are handled by the corruption policy when the file is indexed
+	err = scanFile(ctx, view, itemsOffset(header.version), func(it item) {
+		header.flags |= itemFileFlags(it)
+	})
+	if err != nil && ctx.Err() != nil {
+		return err
+	}
+
+	header.version = currentFormatVersion
+	if err = writeFileHeader(file, header); err != nil {
+		return err
+	}
+
+	return file.Sync()
+}
+
+func readFileVersion(filePath string, opts *options) (uint16, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	header, err := readFileHeader(file)
+	if err == nil {
+		err = header.check(opts)
+	}
+
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", filePath, err)
+	}
+
+	return header.version, nil
+}
+
+// Rewrite all the non-deleted items of an older format file into a new file
+// with the current format and replace the original one
+func migrateFile(ctx context.Context, filePath string, header fileHeader) error {
+	version := header.version
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	migratedPath := filePath + migrationFileExtension
+	migratedFile, err := os.Create(migratedPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(migratedPath)
+	defer migratedFile.Close()
+
+	// Items are copied as they are, the new file keeps the creation flags of the original file
+	// and the encryption of the copied items
+	migratedHeader := fileHeader{version: currentFormatVersion, flags: header.flags}
+	if err = writeFileHeader(migratedFile, migratedHeader); err != nil {
+		return err
+	}
+
+	view, err := fileView(file, version)
+	if err != nil {
+		return err
+	}
+
+	var insertErr error
+	migratedFileSize := int64(fileHeaderLenght)
+	err = scanFile(ctx, view, itemsOffset(version), func(it item) {
+		if it.deleted || insertErr != nil {
+			return
+		}
+
+		migratedHeader.flags |= itemFileFlags(it)
+
+		var itemSize int64
+		itemSize, insertErr = insertItemToFile(migratedFile, migratedFileSize, it)
+		migratedFileSize += itemSize
+	})
+
+	if err != nil {
+		if version == legacyFormatVersion {
+			return fmt.Errorf("%s: %w: %v", filePath, ErrNotLokiFile, err)
+		}
+		return err
+	}
+
+	if insertErr != nil {
+		return insertErr
+	}
+
+	if err = writeFileHeader(migratedFile, migratedHeader); err != nil {
+		return err
+	}
+
+	if err = migratedFile.Sync(); err != nil {
+		return err
+	}
+
+	if err = migratedFile.Close(); err != nil {
+		return err
+	}
+
+	os.Remove(hintPath(filePath))
+
+	return replaceFile(migratedPath, filePath)
+}
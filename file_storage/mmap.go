@@ -0,0 +1,68 @@
+package filestore
+
+import (
+	"io"
+)
+
+// Memory mapped data file, implements io.ReaderAt
+type mappedReader []byte
+
+func (m mappedReader) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(m)) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, m[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+// Return view of the segment for reading, using the memory mapping when enabled
+func (fs *FileKeyValueStore) readView(seg *segment) (dataView, error) {
+	if seg.reader == nil {
+		return dataView{}, ErrClosed
+	}
+
+	if fs.options.mmap && mmapSupported {
+		return seg.mappedView()
+	}
+
+	return seg.fileView(), nil
+}
+
+// Return view of the memory mapped segment, the segment is remapped
+// when it grew or was replaced since it was mapped
+func (seg *segment) mappedView() (dataView, error) {
+	if seg.mapping == nil || int64(len(seg.mapping)) < seg.size {
+		if err := seg.remap(); err != nil {
+			return dataView{}, err
+		}
+	}
+
+	return dataView{reader: mappedReader(seg.mapping), size: int64(len(seg.mapping)), name: seg.path, version: seg.version}, nil
+}
+
+func (seg *segment) remap() error {
+	seg.unmap()
+
+	mapping, err := mmapFile(seg.reader, int(seg.size))
+	if err != nil {
+		return err
+	}
+
+	seg.mapping = mapping
+
+	return nil
+}
+
+func (seg *segment) unmap() {
+	if seg.mapping == nil {
+		return
+	}
+
+	munmapFile(seg.mapping)
+	seg.mapping = nil
+}
@@ -0,0 +1,18 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package filestore
+
+import (
+	"fmt"
+	"os"
+)
+
+const mmapSupported = false
+
+func mmapFile(file *os.File, size int) ([]byte, error) {
+	return nil, fmt.Errorf("mmap is not supported on this platform")
+}
+
+func munmapFile(data []byte) error {
+	return nil
+}
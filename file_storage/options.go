@@ -0,0 +1,173 @@
+package filestore
+
+import (
+	"log"
+	"time"
+
+	"github.com/lokidb/engine/v2/encryption"
+)
+
+// Decide what to do when a corrupted item is found while reading a file
+type CorruptionPolicy int
+
+const (
+	// Return a *CorruptionError to the caller
+	FailOnCorruption CorruptionPolicy = iota
+	// Report the corrupted item and continue with the next one, after items with invalid lenght
+	// the next valid item is searched and the file is truncated only when there is none
+	SkipCorrupted
+	// Report the corrupted item and truncate the file from its position
+	TruncateCorrupted
+)
+
+type options struct {
+	corruptionPolicy   CorruptionPolicy
+	corruptionReporter func(*CorruptionError)
+	maxKeyLenght       int
+	maxValueLenght     int
+	mmap               bool
+
+	compressionCodec     byte
+	compressionThreshold int
+
+	keyProvider encryption.KeyProvider
+	encryptKeys bool
+
+	syncPolicy   SyncPolicy
+	syncInterval time.Duration
+
+	maxSegmentSize int64
+
+	readOnly bool
+
+	expirySweepInterval time.Duration
+
+	compactionPolicy      CompactionPolicy
+	compactionTrigger     func(*FileKeyValueStore)
+	compactionRateLimiter RateLimiter
+}
+
+type Option func(*options)
+
+func defaultOptions() options {
+	return options{
+		corruptionPolicy: FailOnCorruption,
+		maxKeyLenght:     defaultMaxKeyLenght,
+		maxValueLenght:   defaultMaxValueLenght,
+		compactionPolicy: DefaultCompactionPolicy,
+		syncPolicy:       SyncNever,
+		maxSegmentSize:   defaultMaxSegmentSize,
+
+		expirySweepInterval: defaultExpirySweepInterval,
+		corruptionReporter: func(err *CorruptionError) {
+			log.Printf("filestore: %v", err)
+		},
+	}
+}
+
+func WithCorruptionPolicy(policy CorruptionPolicy) Option {
+	return func(o *options) {
+		o.corruptionPolicy = policy
+	}
+}
+
+// Function that will be called for every corrupted item that is skipped or truncated
+func WithCorruptionReporter(reporter func(*CorruptionError)) Option {
+	return func(o *options) {
+		o.corruptionReporter = reporter
+	}
+}
+
+// Set the maximum key lenght in bytes (default 255)
+func WithMaxKeyLenght(maxKeyLenght int) Option {
+	return func(o *options) {
+		o.maxKeyLenght = maxKeyLenght
+	}
+}
+
+// Set the maximum value lenght in bytes (default 16 MiB)
+func WithMaxValueLenght(maxValueLenght int) Option {
+	return func(o *options) {
+		o.maxValueLenght = maxValueLenght
+	}
+}
+
+// Read items through memory mapping of the data file instead of file reads,
+// ignored on platforms without mmap support
+func WithMmap(enabled bool) Option {
+	return func(o *options) {
+		o.mmap = enabled
+	}
+}
+
+// Set when the file needs compaction
+func WithCompactionPolicy(policy CompactionPolicy) Option {
+	return func(o *options) {
+		o.compactionPolicy = policy
+	}
+}
+
+// Function that is called when the file needs compaction instead of compacting it
+// in the background, the function must not block
+func WithCompactionTrigger(trigger func(*FileKeyValueStore)) Option {
+	return func(o *options) {
+		o.compactionTrigger = trigger
+	}
+}
+
+// Limit the rate of bytes written while compacting the file
+func WithCompactionRateLimiter(limiter RateLimiter) Option {
+	return func(o *options) {
+		o.compactionRateLimiter = limiter
+	}
+}
+
+// Compress values larger then threshold bytes with the codec, values are stored
+// compressed only when it saves space
+func WithCompression(codec byte, threshold int) Option {
+	return func(o *options) {
+		o.compressionCodec = codec
+		o.compressionThreshold = threshold
+	}
+}
+
+// Encrypt values with AES-GCM using keys from the provider, with encryptKeys the keys
+// and the hint file are encrypted too. Existing items are encrypted when they are rewritten
+// by compaction or by Reencrypt.
+func WithEncryption(provider encryption.KeyProvider, encryptKeys bool) Option {
+	return func(o *options) {
+		o.keyProvider = provider
+		o.encryptKeys = encryptKeys
+	}
+}
+
+// Set when written items are synced to disk (default SyncNever), interval is used by SyncInterval
+func WithSyncPolicy(policy SyncPolicy, interval time.Duration) Option {
+	return func(o *options) {
+		o.syncPolicy = policy
+		o.syncInterval = interval
+	}
+}
+
+// Start a new segment once the active segment reaches size bytes (default 64 MiB), 0 disables rollover
+func WithMaxSegmentSize(size int64) Option {
+	return func(o *options) {
+		o.maxSegmentSize = size
+	}
+}
+
+// Open existing files without creating or changing anything, mutations return ErrReadOnly
+// and older format versions are read without migration
+func WithReadOnly(readOnly bool) Option {
+	return func(o *options) {
+		o.readOnly = readOnly
+	}
+}
+
+// Set how often expired keys are deleted in the background (default 1 minute), 0 disables the sweeper
+// and expired keys are deleted only by compaction. Expired keys are never returned either way.
+func WithExpirySweepInterval(interval time.Duration) Option {
+	return func(o *options) {
+		o.expirySweepInterval = interval
+	}
+}
@@ -0,0 +1,228 @@
+package filestore
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"github.com/lokidb/engine/v2/cursor"
+)
+
+// Change the bytes of the value of key starting at offset, the value grows when the patch ends after it.
+// Values stored as is in the active segment are patched in place when the patch fits in the stored value,
+// other patches are written as patch items that are applied to the value on read, sealed segments are never changed.
+// Patch items are merged with the value when the chain of fragments grows long and on compaction.
+// In place patches write the data before the new checksum and sequence of the item, a crash between them
+// leaves a corrupted item that is handled by the corruption policy.
+func (fs *FileKeyValueStore) Patch(key string, offset int64, data []byte) error {
+	fs.lock.Lock()
+
+	err, replaced := fs.iPatch(key, offset, data)
+
+	if replaced && fs.NeedsCompaction() {
+		fs.requestCompaction()
+	}
+
+	seq := fs.syncer.lastWrite()
+	fs.lock.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	return fs.waitDurable(seq)
+}
+
+func (fs *FileKeyValueStore) iPatch(key string, offset int64, data []byte) (error, bool) {
+	err := isValidKey(key, fs.options.maxKeyLenght)
+	if err != nil {
+		return err, false
+	}
+
+	if offset < 0 {
+		return fmt.Errorf("%w: negative patch offset %d", ErrInvalidValue, offset), false
+	}
+
+	if err := fs.checkUsable(); err != nil {
+		return err, false
+	}
+
+	if fs.options.readOnly {
+		return ErrReadOnly, false
+	}
+
+	entry, exists := fs.liveEntry(key)
+	if !exists {
+		return ErrNotFound, false
+	}
+
+	if len(data) == 0 {
+		return nil, false
+	}
+
+	valueLenght, err := fs.valueLenght(key, entry)
+	if err != nil {
+		return err, false
+	}
+
+	if offset > valueLenght {
+		return fmt.Errorf("%w: patch offset %d is beyond the value lenght %d", ErrInvalidValue, offset, valueLenght), false
+	}
+
+	err = isValidValueLenght(max64(valueLenght, offset+int64(len(data))), fs.options.maxValueLenght)
+	if err != nil {
+		return err, false
+	}
+
+	patched, err := fs.patchInPlace(key, entry, offset, data)
+	if err != nil || patched {
+		return err, false
+	}
+
+	// Long chains are replaced by a single item with the whole patched value
+	if len(entry.fragments) >= maxFragments {
+		value, err := fs.readValue(entry)
+		if err != nil {
+			return err, false
+		}
+
+		if end := offset + int64(len(data)); end > int64(len(value)) {
+			value = append(value, make([]byte, end-int64(len(value)))...)
+		}
+		copy(value[offset:], data)
+
+		return fs.iSetWithExpiry(key, value, entry.expiresAt)
+	}
+
+	it, err := encodeItem(key, data, &fs.options)
+	if err != nil {
+		return err, false
+	}
+	it.setPatch(offset)
+
+	_, err = fs.appendItem(key, it)
+	return err, false
+}
+
+// Patch the value of the item of entry in place when it is stored as is in the active segment,
+// with a sequence and without fragments, and the patch fits in it. Returns false when the item can't be patched in place.
+// Items are not changed while snapshots are open since they may read them.
+func (fs *FileKeyValueStore) patchInPlace(key string, entry indexEntry, offset int64, data []byte) (bool, error) {
+	active := fs.active()
+	if entry.segment != active.id || len(entry.fragments) > 0 || len(fs.snapshots) > 0 {
+		return false, nil
+	}
+
+	view, err := fs.readView(active)
+	if err != nil {
+		return false, err
+	}
+
+	header, err := readItemHeader(view.reader, entry.position, view.size, view.version)
+	if err != nil {
+		return false, asCorruption(err, view, entry.position)
+	}
+
+	stored := header.codec == NoCompression && header.flags&(encryptedValueFlag|fragmentFlag|sequenceFlag) == sequenceFlag
+	if !stored || offset+int64(len(data)) > header.valueLenght {
+		return false, nil
+	}
+
+	// The sequence follows the flags and codec bytes
+	sequence := fs.nextSequence()
+	patchedHeader := make([]byte, len(header.checksummed))
+	copy(patchedHeader, header.checksummed)
+	binary.LittleEndian.PutUint64(patchedHeader[2:], sequence)
+
+	oldChecksum, newChecksum, err := patchedChecksums(view, entry.position, header, patchedHeader, offset, data)
+	if err != nil {
+		return false, err
+	}
+
+	if oldChecksum != header.checksum {
+		return false, &CorruptionError{Path: view.name, Offset: entry.position, Reason: "checksum mismatch", next: -1}
+	}
+
+	// The hint would index the previous version of the item after a crash
+	fs.invalidateHint()
+
+	// Reads go through the data view and writes through the write handle of the active segment
+	file := struct {
+		io.ReaderAt
+		io.WriterAt
+	}{view.reader, active.writer}
+
+	value := cursor.NewWritable(file, entry.position+header.size+header.keyLenght, header.valueLenght)
+	if _, err = value.WriteAt(data, offset); err != nil {
+		return false, err
+	}
+
+	checksum := make([]byte, checksumLenght)
+	binary.LittleEndian.PutUint32(checksum, newChecksum)
+	if _, err = active.writer.WriteAt(append(checksum, patchedHeader[:2+sequenceLenght]...), entry.position); err != nil {
+		return false, err
+	}
+
+	active.sequence = sequence
+	entry.version = sequence
+	fs.keysIndex[key] = entry
+	fs.syncer.write()
+
+	return true, nil
+}
+
+// Checksums of the item before and after the patch, computed with a single read of the item,
+// patchedHeader is the checksummed part of the header after the patch
+func patchedChecksums(view dataView, position int64, header itemHeader, patchedHeader []byte, offset int64, data []byte) (uint32, uint32, error) {
+	buf := make([]byte, streamBufferLenght)
+
+	key := make([]byte, header.keyLenght)
+	if _, err := view.reader.ReadAt(key, position+header.size); err != nil {
+		return 0, 0, asCorruption(err, view, position)
+	}
+
+	oldCrc := crc32.Update(crc32.Update(0, crcTable, header.checksummed), crcTable, key)
+	newCrc := crc32.Update(crc32.Update(0, crcTable, patchedHeader), crcTable, key)
+
+	value := cursor.New(view.reader, position+header.size+header.keyLenght, header.valueLenght)
+	patchEnd := offset + int64(len(data))
+
+	for chunkStart := int64(0); chunkStart < header.valueLenght; {
+		n, err := value.ReadAt(buf, chunkStart)
+		if err != nil && (err != io.EOF || chunkStart+int64(n) != header.valueLenght) {
+			return 0, 0, asCorruption(err, view, position)
+		}
+
+		chunk := buf[:n]
+		oldCrc = crc32.Update(oldCrc, crcTable, chunk)
+
+		// Apply the overlapping part of the patch to the chunk
+		chunkEnd := chunkStart + int64(n)
+		if offset < chunkEnd && patchEnd > chunkStart {
+			from, to := max64(offset, chunkStart), min64(patchEnd, chunkEnd)
+			copy(chunk[from-chunkStart:to-chunkStart], data[from-offset:to-offset])
+		}
+
+		newCrc = crc32.Update(newCrc, crcTable, chunk)
+		chunkStart = chunkEnd
+	}
+
+	return oldCrc, newCrc, nil
+}
+
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+
+	return b
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+
+	return b
+}
@@ -0,0 +1,64 @@
+package filestore
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// Resolve temporary files left behind by compaction or migration that were interrupted,
+// the temporary file replaces the original only by atomic rename so when the original
+// exists it is always complete and the temporary file can be removed
+func recoverInterruptedRewrite(filePath string) error {
+	for _, extension := range []string{cleanFileExtension, migrationFileExtension} {
+		tempPath := filePath + extension
+
+		if _, err := os.Stat(tempPath); os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if _, err := os.Stat(filePath); err == nil {
+			if err = os.Remove(tempPath); err != nil {
+				return err
+			}
+
+			continue
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+
+		// Older versions removed the original file before renaming the clean file,
+		// in that case the clean file is the only copy of the data
+		os.Remove(hintPath(filePath))
+		if err := os.Rename(tempPath, filePath); err != nil {
+			return err
+		}
+
+		if err := syncDir(filePath); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Replace the file with the temporary file and make sure the rename is durable
+func replaceFile(tempPath string, filePath string) error {
+	if err := os.Rename(tempPath, filePath); err != nil {
+		return err
+	}
+
+	return syncDir(filePath)
+}
+
+// Fsync the directory of the file so renames and new files survive a crash
+func syncDir(filePath string) error {
+	dir, err := os.Open(filepath.Dir(filePath))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	return dir.Sync()
+}
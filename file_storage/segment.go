@@ -0,0 +1,217 @@
+package filestore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The data of a store is split into segments, every segment is a data file with its own header.
+// Items are appended only to the last (active) segment, when it reaches the maximum segment size
+// a new segment is created and the previous one is not appended anymore.
+// Segment 0 is stored at the store path and the next segments at <path>.000001, <path>.000002...
+const segmentSuffixLenght = 6
+
+type segment struct {
+	id              uint32
+	path            string
+	reader          *os.File
+	writer          *os.File
+	size            int64
+	version         uint16
+	mapping         []byte
+	deletedKeyCount int
+	deadBytes       int64
+	pinnedBytes     int64  // dead bytes that the last rewrite kept for open snapshots
+	sequence        uint64 // highest sequence number of the items that were written to the segment
+}
+
+func segmentPath(filePath string, id uint32) string {
+	if id == 0 {
+		return filePath
+	}
+
+	return fmt.Sprintf("%s.%0*d", filePath, segmentSuffixLenght, id)
+}
+
+// Find the ids of the store segments on disk sorted by id, segment 0 is always included
+func listSegments(filePath string) ([]uint32, error) {
+	entries, err := os.ReadDir(filepath.Dir(filePath))
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := filepath.Base(filePath) + "."
+	ids := []uint32{0}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, prefix) || len(name)-len(prefix) != segmentSuffixLenght {
+			continue
+		}
+
+		id, err := strconv.ParseUint(name[len(prefix):], 10, 32)
+		if err != nil || id == 0 {
+			continue
+		}
+
+		ids = append(ids, uint32(id))
+	}
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	return ids, nil
+}
+
+func (seg *segment) open(writable bool) error {
+	reader, err := os.Open(seg.path)
+	if err != nil {
+		return err
+	}
+
+	fileInfo, err := reader.Stat()
+	if err != nil {
+		reader.Close()
+		return err
+	}
+
+	if writable {
+		writer, err := os.OpenFile(seg.path, os.O_WRONLY, os.FileMode(filePermissions))
+		if err != nil {
+			reader.Close()
+			return err
+		}
+
+		seg.writer = writer
+	}
+
+	seg.reader = reader
+	seg.size = fileInfo.Size()
+
+	return nil
+}
+
+func (seg *segment) close() error {
+	seg.unmap()
+
+	if seg.reader == nil {
+		return nil
+	}
+
+	err := seg.reader.Close()
+	seg.reader = nil
+
+	if seg.writer != nil {
+		if writerErr := seg.writer.Close(); err == nil {
+			err = writerErr
+		}
+		seg.writer = nil
+	}
+
+	return err
+}
+
+// View of the segment file through the read handle
+func (seg *segment) fileView() dataView {
+	return dataView{reader: seg.reader, size: seg.size, name: seg.path, version: seg.version}
+}
+
+func (seg *segment) itemsSize() int64 {
+	return seg.size - itemsOffset(seg.version)
+}
+
+// Active segment that new items are appended to
+func (fs *FileKeyValueStore) active() *segment {
+	return fs.segments[len(fs.segments)-1]
+}
+
+func (fs *FileKeyValueStore) segment(id uint32) *segment {
+	return findSegment(fs.segments, id)
+}
+
+func findSegment(segments []*segment, id uint32) *segment {
+	i := sort.Search(len(segments), func(i int) bool { return segments[i].id >= id })
+	if i < len(segments) && segments[i].id == id {
+		return segments[i]
+	}
+
+	return nil
+}
+
+// Count the item of the index entry and its fragments as dead in their segments
+func markDead(segments []*segment, entry indexEntry) {
+	if seg := findSegment(segments, entry.segment); seg != nil {
+		seg.deletedKeyCount++
+		seg.deadBytes += entry.size
+	}
+
+	for _, fragment := range entry.fragments {
+		markDead(segments, fragment)
+	}
+}
+
+// Start new active segment when the active segment reached the maximum segment size,
+// the previous segment is synced so it is complete on disk once it is not appended anymore
+// and its write handle is closed
+func (fs *FileKeyValueStore) rolloverIfFull() error {
+	active := fs.active()
+	if fs.options.maxSegmentSize <= 0 || active.size < fs.options.maxSegmentSize {
+		return nil
+	}
+
+	if err := active.writer.Sync(); err != nil {
+		return err
+	}
+
+	seg := &segment{id: active.id + 1, version: currentFormatVersion}
+	seg.path = segmentPath(fs.filePath, seg.id)
+
+	file, err := os.Create(seg.path)
+	if err != nil {
+		return err
+	}
+
+	err = writeFileHeader(file, newFileHeader(&fs.options))
+	file.Close()
+	if err == nil {
+		err = syncDir(seg.path)
+	}
+
+	if err == nil {
+		err = seg.open(true)
+	}
+
+	if err != nil {
+		os.Remove(seg.path)
+		return err
+	}
+
+	fs.handlesLock.Lock()
+	defer fs.handlesLock.Unlock()
+
+	fs.segments = append(fs.segments, seg)
+	err = active.writer.Close()
+	active.writer = nil
+
+	return err
+}
+
+// Number of dead items in all the segments
+func (fs *FileKeyValueStore) deletedKeyCount() int {
+	count := 0
+	for _, seg := range fs.segments {
+		count += seg.deletedKeyCount
+	}
+
+	return count
+}
+
+func (fs *FileKeyValueStore) openSegment(seg *segment, writable bool) error {
+	fs.handlesLock.Lock()
+	defer fs.handlesLock.Unlock()
+
+	return seg.open(writable)
+}
@@ -0,0 +1,148 @@
+package filestore
+
+import (
+	"context"
+	"time"
+
+	"github.com/lokidb/engine/v2/cursor"
+)
+
+// Read-only view of the store as of the time it was created. The snapshot holds a copy of the keys index
+// and reads the items at their positions, compaction keeps the items that open snapshots read and moves
+// the snapshots to their new locations. Snapshots must be released.
+type Snapshot struct {
+	fs        *FileKeyValueStore
+	keysIndex map[string]indexEntry
+	now       int64 // creation time in unix milliseconds, keys that expired before it are hidden
+	released  bool
+}
+
+// Create snapshot of the current keys
+func (fs *FileKeyValueStore) Snapshot() (*Snapshot, error) {
+	return fs.SnapshotAt(time.Now())
+}
+
+// Create snapshot of the current keys that hides the keys expired at now,
+// snapshots of many stores created with the same time agree on the expired keys
+func (fs *FileKeyValueStore) SnapshotAt(now time.Time) (*Snapshot, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	if err := fs.checkUsable(); err != nil {
+		return nil, err
+	}
+
+	// Entries are values and their fragments slices are never changed in place
+	keysIndex := make(map[string]indexEntry, len(fs.keysIndex))
+	for key, entry := range fs.keysIndex {
+		keysIndex[key] = entry
+	}
+
+	snap := &Snapshot{fs: fs, keysIndex: keysIndex, now: now.UnixMilli()}
+	if fs.snapshots == nil {
+		fs.snapshots = make(map[*Snapshot]struct{})
+	}
+	fs.snapshots[snap] = struct{}{}
+
+	return snap, nil
+}
+
+// Check the snapshot can be read, called with the store lock held
+func (snap *Snapshot) check() error {
+	if err := snap.fs.checkUsable(); err != nil {
+		return err
+	}
+
+	if snap.released {
+		return ErrSnapshotReleased
+	}
+
+	return nil
+}
+
+// Value of key as of the snapshot creation, or file cursor when valueReader is not nil
+func (snap *Snapshot) Get(key string, valueReader func(cursor.Cursor) ([]byte, error)) ([]byte, error) {
+	value, _, err := snap.GetWithVersion(key, valueReader)
+	return value, err
+}
+
+// Value and version of key as of the snapshot creation
+func (snap *Snapshot) GetWithVersion(key string, valueReader func(cursor.Cursor) ([]byte, error)) ([]byte, uint64, error) {
+	fs := snap.fs
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	err := isValidKey(key, fs.options.maxKeyLenght)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if err = snap.check(); err != nil {
+		return nil, 0, err
+	}
+
+	entry, exists := snap.keysIndex[key]
+	if !exists || entry.expired(snap.now) {
+		return nil, 0, ErrNotFound
+	}
+
+	value, err := fs.readEntry(entry, valueReader)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return value, entry.version, nil
+}
+
+func (snap *Snapshot) Keys() ([]string, error) {
+	snap.fs.lock.Lock()
+	defer snap.fs.lock.Unlock()
+
+	if err := snap.check(); err != nil {
+		return nil, err
+	}
+
+	return liveKeys(snap.keysIndex, snap.now), nil
+}
+
+func (snap *Snapshot) Search(ctx context.Context, evaluate func(value []byte) bool) ([][]byte, error) {
+	fs := snap.fs
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	if err := snap.check(); err != nil {
+		return nil, err
+	}
+
+	return fs.search(ctx, snap.keysIndex, snap.now, evaluate)
+}
+
+// Release the snapshot, the dead items that were kept for snapshots are compacted
+// once the last snapshot is released
+func (snap *Snapshot) Release() error {
+	fs := snap.fs
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	if snap.released {
+		return ErrSnapshotReleased
+	}
+
+	snap.released = true
+	snap.keysIndex = nil
+	delete(fs.snapshots, snap)
+
+	if len(fs.snapshots) > 0 {
+		return nil
+	}
+
+	for _, seg := range fs.segments {
+		seg.pinnedBytes = 0
+	}
+
+	if !fs.closed() && !fs.options.readOnly && fs.NeedsCompaction() {
+		fs.requestCompaction()
+	}
+
+	return nil
+}
@@ -0,0 +1,260 @@
+package filestore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+const streamBufferLenght = 64 << 10
+
+// Store value read from r, size is the value lenght. Values stored without compression and
+// encryption are streamed to the active segment, other values are encoded in memory.
+func (fs *FileKeyValueStore) SetReader(key string, r io.Reader, size int64) error {
+	fs.lock.Lock()
+
+	err, replaced := fs.iSetReader(key, r, size)
+
+	if replaced && fs.NeedsCompaction() {
+		fs.requestCompaction()
+	}
+
+	seq := fs.syncer.lastWrite()
+	fs.lock.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	return fs.waitDurable(seq)
+}
+
+func (fs *FileKeyValueStore) iSetReader(key string, r io.Reader, size int64) (error, bool) {
+	err := isValidKey(key, fs.options.maxKeyLenght)
+	if err != nil {
+		return err, false
+	}
+
+	err = isValidValueLenght(size, fs.options.maxValueLenght)
+	if err != nil {
+		return err, false
+	}
+
+	if err := fs.checkUsable(); err != nil {
+		return err, false
+	}
+
+	if fs.options.readOnly {
+		return ErrReadOnly, false
+	}
+
+	if !fs.streamable(size) {
+		value := make([]byte, size)
+		if _, err = io.ReadFull(r, value); err != nil {
+			return shortValueError(size, err), false
+		}
+
+		return fs.iSet(key, value)
+	}
+
+	fs.invalidateHint()
+
+	if err = fs.rolloverIfFull(); err != nil {
+		return err, false
+	}
+
+	it := item{key: key, valueLenght: size}
+	it.setSequence(fs.nextSequence())
+
+	active := fs.active()
+	itemSize, err := insertStreamToFile(active.writer, active.size, it, r, size)
+	if err != nil {
+		// Drop the partly written item so the segment ends with a complete item
+		active.writer.Truncate(active.size)
+		return err, false
+	}
+
+	return nil, fs.indexAppended(key, itemSize, it)
+}
+
+// Values are streamed only when they are stored as is
+func (fs *FileKeyValueStore) streamable(size int64) bool {
+	if fs.options.keyProvider != nil {
+		return false
+	}
+
+	return fs.options.compressionCodec == NoCompression || size < int64(fs.options.compressionThreshold)
+}
+
+// Write item with value read from r at the given position and return the item size,
+// the checksum is written last after the whole value was written
+func insertStreamToFile(file io.WriterAt, itemPosition int64, it item, r io.Reader, size int64) (int64, error) {
+	itemHeader := encodeItemHeaderFields(it, size)
+	prefix := append(itemHeader, it.key...)
+
+	crc := crc32.Update(0, crcTable, prefix[checksumLenght:])
+	if _, err := file.WriteAt(prefix, itemPosition); err != nil {
+		return 0, err
+	}
+
+	buf := make([]byte, streamBufferLenght)
+	offset := itemPosition + int64(len(prefix))
+
+	for remaining := size; remaining > 0; {
+		chunk := buf
+		if remaining < int64(len(chunk)) {
+			chunk = chunk[:remaining]
+		}
+
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return 0, shortValueError(size, err)
+		}
+
+		if _, err := file.WriteAt(chunk, offset); err != nil {
+			return 0, err
+		}
+
+		crc = crc32.Update(crc, crcTable, chunk)
+		offset += int64(len(chunk))
+		remaining -= int64(len(chunk))
+	}
+
+	binary.LittleEndian.PutUint32(itemHeader, crc)
+	if _, err := file.WriteAt(itemHeader[:checksumLenght], itemPosition); err != nil {
+		return 0, err
+	}
+
+	return offset - itemPosition, nil
+}
+
+func shortValueError(size int64, err error) error {
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return fmt.Errorf("reading value of %d bytes: %w", size, err)
+}
+
+// Write the value of key to w and return the number of bytes written,
+// the item checksum is verified after the whole value was written
+func (fs *FileKeyValueStore) GetTo(key string, w io.Writer) (int64, error) {
+	value, err := fs.openValue(key)
+	if err != nil {
+		return 0, err
+	}
+	defer value.Close()
+
+	checksum := crcWriter{crc: value.crc}
+	n, err := io.Copy(io.MultiWriter(w, &checksum), value)
+	if err != nil {
+		return n, err
+	}
+
+	if value.verify && checksum.crc != value.checksum {
+		return n, &CorruptionError{Path: value.path, Offset: value.position, Reason: "checksum mismatch", next: -1}
+	}
+
+	return n, nil
+}
+
+// Open the value of key for reading, the reader has its own file handle so it stays valid
+// after the key is changed or the segment is compacted. Partial reads are not verified against the item checksum.
+func (fs *FileKeyValueStore) Open(key string) (io.ReadSeekCloser, error) {
+	return fs.openValue(key)
+}
+
+// Reader of a stored value
+type valueReader struct {
+	*io.SectionReader
+	file *os.File // nil when the value was decoded in memory
+
+	// checksum of the item before the value, used for verifying full reads
+	crc      uint32
+	checksum uint32
+	verify   bool
+	path     string
+	position int64
+}
+
+func (v *valueReader) Close() error {
+	if v.file == nil {
+		return nil
+	}
+
+	return v.file.Close()
+}
+
+type crcWriter struct {
+	crc uint32
+}
+
+func (c *crcWriter) Write(p []byte) (int, error) {
+	c.crc = crc32.Update(c.crc, crcTable, p)
+	return len(p), nil
+}
+
+func (fs *FileKeyValueStore) openValue(key string) (*valueReader, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	err := isValidKey(key, fs.options.maxKeyLenght)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := fs.checkUsable(); err != nil {
+		return nil, err
+	}
+
+	entry, exists := fs.liveEntry(key)
+	if !exists {
+		return nil, ErrNotFound
+	}
+
+	seg := fs.segment(entry.segment)
+	view, err := fs.readView(seg)
+	if err != nil {
+		return nil, err
+	}
+
+	header, err := readItemHeader(view.reader, entry.position, view.size, view.version)
+	if err != nil {
+		return nil, asCorruption(err, view, entry.position)
+	}
+
+	// Compressed, encrypted and fragmented values are decoded in memory
+	if header.codec != NoCompression || header.flags&encryptedValueFlag != 0 || len(entry.fragments) > 0 {
+		value, err := fs.readValue(entry)
+		if err != nil {
+			return nil, err
+		}
+
+		return &valueReader{SectionReader: io.NewSectionReader(bytes.NewReader(value), 0, int64(len(value)))}, nil
+	}
+
+	storedKey := make([]byte, header.keyLenght)
+	if _, err = view.reader.ReadAt(storedKey, entry.position+header.size); err != nil {
+		return nil, asCorruption(err, view, entry.position)
+	}
+
+	file, err := os.Open(seg.path)
+	if err != nil {
+		return nil, err
+	}
+
+	crc := crc32.Update(0, crcTable, header.checksummed)
+	valuePosition := entry.position + header.size + header.keyLenght
+
+	return &valueReader{
+		SectionReader: io.NewSectionReader(file, valuePosition, header.valueLenght),
+		file:          file,
+		crc:           crc32.Update(crc, crcTable, storedKey),
+		checksum:      header.checksum,
+		verify:        view.version >= 2,
+		path:          seg.path,
+		position:      entry.position,
+	}, nil
+}
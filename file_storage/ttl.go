@@ -0,0 +1,209 @@
+package filestore
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/lokidb/engine/v2/cursor"
+)
+
+// Store key value that expires after ttl, expired keys are hidden immediately
+// and deleted from the file by the expiry sweeper and by compaction
+func (fs *FileKeyValueStore) SetWithTTL(key string, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("%w: %v", ErrInvalidTTL, ttl)
+	}
+
+	fs.lock.Lock()
+
+	err, replaced := fs.iSetWithExpiry(key, value, expiryTime(ttl))
+
+	if replaced && fs.NeedsCompaction() {
+		fs.requestCompaction()
+	}
+
+	seq := fs.syncer.lastWrite()
+	fs.lock.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	return fs.waitDurable(seq)
+}
+
+// Set the key to expire after ttl, the whole value is written again with the new expiry
+func (fs *FileKeyValueStore) Expire(key string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("%w: %v", ErrInvalidTTL, ttl)
+	}
+
+	fs.lock.Lock()
+
+	err, replaced := fs.iExpire(key, expiryTime(ttl))
+
+	if replaced && fs.NeedsCompaction() {
+		fs.requestCompaction()
+	}
+
+	seq := fs.syncer.lastWrite()
+	fs.lock.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	return fs.waitDurable(seq)
+}
+
+func (fs *FileKeyValueStore) iExpire(key string, expiresAt int64) (error, bool) {
+	err := isValidKey(key, fs.options.maxKeyLenght)
+	if err != nil {
+		return err, false
+	}
+
+	if err := fs.checkUsable(); err != nil {
+		return err, false
+	}
+
+	if fs.options.readOnly {
+		return ErrReadOnly, false
+	}
+
+	entry, exists := fs.liveEntry(key)
+	if !exists {
+		return ErrNotFound, false
+	}
+
+	value, err := fs.readValue(entry)
+	if err != nil {
+		return err, false
+	}
+
+	return fs.iSetWithExpiry(key, value, expiresAt)
+}
+
+// Remaining time to live of key, 0 for keys that never expire
+func (fs *FileKeyValueStore) TTL(key string) (time.Duration, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	err := isValidKey(key, fs.options.maxKeyLenght)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := fs.checkUsable(); err != nil {
+		return 0, err
+	}
+
+	entry, exists := fs.liveEntry(key)
+	if !exists {
+		return 0, ErrNotFound
+	}
+
+	return entry.ttl(), nil
+}
+
+// Get value of key with its remaining time to live, 0 for keys that never expire
+func (fs *FileKeyValueStore) GetWithTTL(key string, valueReader func(cursor.Cursor) ([]byte, error)) ([]byte, time.Duration, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	value, err := fs.iGet(key, valueReader)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return value, fs.keysIndex[key].ttl(), nil
+}
+
+func expiryTime(ttl time.Duration) int64 {
+	return time.Now().Add(ttl).UnixMilli()
+}
+
+// Check if the key of the entry expired at now unix milliseconds
+func (entry indexEntry) expired(now int64) bool {
+	return entry.expiresAt != 0 && entry.expiresAt <= now
+}
+
+func (entry indexEntry) ttl() time.Duration {
+	if entry.expiresAt == 0 {
+		return 0
+	}
+
+	return time.Until(time.UnixMilli(entry.expiresAt))
+}
+
+// Index entry of key, expired keys are treated as keys that don't exist
+func (fs *FileKeyValueStore) liveEntry(key string) (indexEntry, bool) {
+	entry, exists := fs.keysIndex[key]
+	if !exists || entry.expired(time.Now().UnixMilli()) {
+		return indexEntry{}, false
+	}
+
+	return entry, true
+}
+
+// Append tombstones of the expired keys so their items become dead and are reclaimed by compaction,
+// returns true when any key was deleted
+func (fs *FileKeyValueStore) deleteExpired() (bool, error) {
+	now := time.Now().UnixMilli()
+	deleted := false
+
+	for key, entry := range fs.keysIndex {
+		if !entry.expired(now) {
+			continue
+		}
+
+		tombstone, err := encodeTombstone(key, &fs.options)
+		if err != nil {
+			return deleted, err
+		}
+
+		if _, err = fs.appendItem(key, tombstone); err != nil {
+			return deleted, err
+		}
+
+		deleted = true
+	}
+
+	return deleted, nil
+}
+
+func (fs *FileKeyValueStore) startExpirySweeper() {
+	fs.stopSweep = make(chan struct{})
+
+	go func(stop chan struct{}) {
+		ticker := time.NewTicker(fs.options.expirySweepInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				fs.sweepExpired()
+			case <-stop:
+				return
+			}
+		}
+	}(fs.stopSweep)
+}
+
+func (fs *FileKeyValueStore) sweepExpired() {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	if fs.checkUsable() != nil {
+		return
+	}
+
+	deleted, err := fs.deleteExpired()
+	if err != nil {
+		log.Printf("filestore: deleting expired keys of %s failed: %v", fs.filePath, err)
+	}
+
+	if deleted && fs.NeedsCompaction() {
+		fs.requestCompaction()
+	}
+}
@@ -1,6 +1,10 @@
 package filestore
 
-import "context"
+import (
+	"context"
+	"fmt"
+	"os"
+)
 
 func equal(a, b []byte) bool {
 	if len(a) != len(b) {
@@ -16,21 +20,66 @@ func equal(a, b []byte) bool {
 	return true
 }
 
-// Scan file and return index of {key: file-offset}
-func createKeysIndex(ctx context.Context, filename string) (*map[string]int64, int, error) {
-	file := openOrCreate(filename)
+// Replay the items of the segments in order and return index of {key: item location},
+// the latest item of a key wins and the dead items statistics are stored on the segments
+func createKeysIndex(ctx context.Context, segments []*segment, opts *options) (map[string]indexEntry, error) {
+	keysIndex := make(map[string]indexEntry)
+
+	for _, seg := range segments {
+		if err := indexSegment(ctx, seg, segments, keysIndex, opts); err != nil {
+			return nil, err
+		}
+	}
+
+	return keysIndex, nil
+}
+
+func indexSegment(ctx context.Context, seg *segment, segments []*segment, keysIndex map[string]indexEntry, opts *options) error {
+	// The file is opened for writing only for truncating corrupted items
+	file, err := os.OpenFile(seg.path, os.O_RDWR, os.FileMode(filePermissions))
+	if opts.readOnly {
+		file, err = os.Open(seg.path)
+	}
+
+	if err != nil {
+		return err
+	}
 	defer file.Close()
 
-	keysIndex := make(map[string]int64)
-	deletedKeysCount := 0
+	seg.deletedKeyCount = 0
+	seg.deadBytes = 0
 
-	err := scanFile(ctx, file, false, func(key string, value []byte, deleted bool, filePosition int64) {
-		if deleted {
-			deletedKeysCount++
-		} else {
-			keysIndex[key] = filePosition
+	header, err := readFileHeader(file)
+	if err != nil {
+		return fmt.Errorf("%s: %w", seg.path, err)
+	}
+	seg.sequence = header.sequence
+
+	var keyErr error
+	err = scanFileWithPolicy(ctx, file, seg.version, itemsOffset(seg.version), opts, func(it item) {
+		if it.sequence > seg.sequence {
+			seg.sequence = it.sequence
 		}
+
+		// Items deleted in place by older format versions
+		if it.deleted {
+			seg.deletedKeyCount++
+			seg.deadBytes += it.size
+			return
+		}
+
+		key, err := decodeItemKey(it, opts.keyProvider)
+		if err != nil {
+			keyErr = err
+			return
+		}
+
+		indexItem(keysIndex, segments, key, indexEntry{segment: seg.id, position: it.position, size: it.size, expiresAt: it.expiresAt, version: it.sequence, valueLenght: it.decodedLenght()}, it)
 	})
 
-	return &keysIndex, deletedKeysCount, err
+	if err == nil {
+		err = keyErr
+	}
+
+	return err
 }
@@ -5,24 +5,28 @@ import (
 )
 
 // Check if the key is valid, returns error for invalid key
-func isValidKey(key string) error {
+func isValidKey(key string, maxKeyLenght int) error {
 	if key == "" {
-		return fmt.Errorf("can't set empty key")
+		return fmt.Errorf("%w: empty key", ErrInvalidKey)
 	}
 
 	if len(key) > maxKeyLenght {
-		return fmt.Errorf("key lenght is grater then %d", maxKeyLenght)
+		return fmt.Errorf("%w: key lenght is grater then %d", ErrInvalidKey, maxKeyLenght)
 	}
 
 	return nil
 }
 
 // Check if the value is valid, returns error for invalid value
-func isValidValue(value []byte) error {
-	if len(value) == 0 {
-		return fmt.Errorf("can't set empty value or nil value")
-	} else if len(value) > maxValueLenght {
-		return fmt.Errorf("value lenght is grater then %d", maxValueLenght)
+func isValidValue(value []byte, maxValueLenght int) error {
+	return isValidValueLenght(int64(len(value)), maxValueLenght)
+}
+
+func isValidValueLenght(valueLenght int64, maxValueLenght int) error {
+	if valueLenght <= 0 {
+		return fmt.Errorf("%w: can't set empty value or nil value", ErrInvalidValue)
+	} else if valueLenght > int64(maxValueLenght) {
+		return fmt.Errorf("%w: value lenght is grater then %d", ErrValueTooLarge, maxValueLenght)
 	}
 
 	return nil
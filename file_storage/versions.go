@@ -0,0 +1,152 @@
+package filestore
+
+import (
+	"github.com/lokidb/engine/v2/cursor"
+)
+
+// Every write of a key gets the next sequence number of the store, the sequence number of the
+// latest write is the version of the key. Versions only grow, also across deletes, compaction and reopen.
+// Keys written before format version 8 have version 0 until they are written again.
+func (fs *FileKeyValueStore) nextSequence() uint64 {
+	fs.sequence++
+	return fs.sequence
+}
+
+// Get value of key with its version
+func (fs *FileKeyValueStore) GetWithVersion(key string, valueReader func(cursor.Cursor) ([]byte, error)) ([]byte, uint64, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	value, err := fs.iGet(key, valueReader)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return value, fs.keysIndex[key].version, nil
+}
+
+// Version of key, returns ErrNotFound when the key doesn't exist
+func (fs *FileKeyValueStore) Version(key string) (uint64, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	err := isValidKey(key, fs.options.maxKeyLenght)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := fs.checkUsable(); err != nil {
+		return 0, err
+	}
+
+	entry, exists := fs.liveEntry(key)
+	if !exists {
+		return 0, ErrNotFound
+	}
+
+	return entry.version, nil
+}
+
+// Set key value only when the key version is expectedVersion and return the new version,
+// returns ErrVersionMismatch when the key was changed and ErrNotFound when it doesn't exist
+func (fs *FileKeyValueStore) CompareAndSwap(key string, expectedVersion uint64, value []byte) (uint64, error) {
+	return fs.setIf(key, value, func(entry indexEntry, exists bool) error {
+		if !exists {
+			return ErrNotFound
+		}
+
+		if entry.version != expectedVersion {
+			return ErrVersionMismatch
+		}
+
+		return nil
+	})
+}
+
+// Set key value only when the key doesn't exist and return the new version,
+// returns ErrKeyExists when it exists
+func (fs *FileKeyValueStore) SetIfAbsent(key string, value []byte) (uint64, error) {
+	return fs.setIf(key, value, func(entry indexEntry, exists bool) error {
+		if exists {
+			return ErrKeyExists
+		}
+
+		return nil
+	})
+}
+
+// Set key value only when the key exists and return the new version,
+// returns ErrNotFound when it doesn't exist
+func (fs *FileKeyValueStore) SetIfExists(key string, value []byte) (uint64, error) {
+	return fs.setIf(key, value, func(entry indexEntry, exists bool) error {
+		if !exists {
+			return ErrNotFound
+		}
+
+		return nil
+	})
+}
+
+// Delete key only when the key version is version, returns ErrVersionMismatch when
+// the key was changed and ErrNotFound when it doesn't exist
+func (fs *FileKeyValueStore) DeleteIfVersion(key string, version uint64) error {
+	fs.lock.Lock()
+
+	err := isValidKey(key, fs.options.maxKeyLenght)
+	deleted := false
+
+	if err == nil && !fs.closed() && !fs.options.readOnly {
+		entry, exists := fs.liveEntry(key)
+		if exists && entry.version != version {
+			err = ErrVersionMismatch
+		}
+	}
+
+	if err == nil {
+		err, deleted = fs.iDel(key)
+	}
+
+	if deleted && fs.NeedsCompaction() {
+		fs.requestCompaction()
+	}
+
+	seq := fs.syncer.lastWrite()
+	fs.lock.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	return fs.waitDurable(seq)
+}
+
+// Set key value when condition returns nil for the current entry of the key, the condition
+// and the write are done under the same lock
+func (fs *FileKeyValueStore) setIf(key string, value []byte, condition func(entry indexEntry, exists bool) error) (uint64, error) {
+	fs.lock.Lock()
+
+	err := isValidKey(key, fs.options.maxKeyLenght)
+	replaced := false
+
+	if err == nil && !fs.closed() && !fs.options.readOnly {
+		err = condition(fs.liveEntry(key))
+	}
+
+	if err == nil {
+		err, replaced = fs.iSet(key, value)
+	}
+
+	if replaced && fs.NeedsCompaction() {
+		fs.requestCompaction()
+	}
+
+	version := fs.sequence
+	seq := fs.syncer.lastWrite()
+	fs.lock.Unlock()
+
+	if err != nil {
+		return 0, err
+	}
+
+	return version, fs.waitDurable(seq)
+}
@@ -1,3 +1,3 @@
-module github.com/lokidb/engine
+module github.com/lokidb/engine/v2
 
 go 1.18
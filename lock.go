@@ -0,0 +1,50 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const lockFilename = "LOCK"
+
+// Returned by New when another process has the store open
+var ErrLocked = errors.New("store is locked by another process")
+
+// Take the lock of the root directory, writers take an exclusive lock and read-only stores a shared lock.
+// Read-only stores don't create the lock file, when it is missing the directory is not locked.
+func lockDirectory(rootPath string, readOnly bool) (*os.File, error) {
+	lockPath := filepath.Join(rootPath, lockFilename)
+
+	var file *os.File
+	var err error
+	if readOnly {
+		file, err = os.Open(lockPath)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+	} else {
+		file, err = os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0600)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err = lockFile(file, !readOnly); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %w", rootPath, err)
+	}
+
+	return file, nil
+}
+
+func unlockDirectory(file *os.File) error {
+	if file == nil {
+		return nil
+	}
+
+	unlockFile(file)
+	return file.Close()
+}
@@ -2,15 +2,19 @@
 package engine
 
 import (
+	"bytes"
 	"context"
+	"io"
 	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/lokidb/engine/consistent"
-	"github.com/lokidb/engine/cursor"
-	filestore "github.com/lokidb/engine/file_storage"
-	lrucache "github.com/lokidb/engine/lrucache"
+	"github.com/lokidb/engine/v2/consistent"
+	"github.com/lokidb/engine/v2/cursor"
+	filestore "github.com/lokidb/engine/v2/file_storage"
+	lrucache "github.com/lokidb/engine/v2/lrucache"
 )
 
 const fileExtension = ".loki"
@@ -21,96 +25,507 @@ const aolFilename = "mutations_log"
 const toggleAOL = false
 
 type storage struct {
-	rootPath   string
-	aolPath    string
-	aolLock    sync.Mutex
-	lruCache   lrucache.Cache
-	fileStores map[string]*filestore.FileKeyValueStore
-	filesRing  consistent.ConsistentHash
+	rootPath     string
+	aolPath      string
+	aolLock      sync.Mutex
+	batchLogPath string
+	batchLock    sync.RWMutex                          // held for writing by batches and for reading by the other writes
+	batchPending bool                                  // the batch log holds a batch that failed to apply, guarded by batchLock
+	batchApplied map[*filestore.FileKeyValueStore]bool // files that applied the batch of the log, guarded by batchLock
+	lruCache     lrucache.Cache
+	fileStores   map[string]*filestore.FileKeyValueStore
+	filesRing    consistent.ConsistentHash
+	compactor    *compactor
+	dirLock      *os.File
+	options      options
+	closed       int32
+	snapshots    int32 // open snapshots
 }
 
+// Every operation returns an error, match it with errors.Is against ErrNotFound, ErrInvalidKey,
+// ErrInvalidValue, ErrValueTooLarge, ErrCorrupted, ErrClosed or ErrReadOnly.
+// Every write gives the key a new version, conditional writes return ErrVersionMismatch or ErrKeyExists.
 type KeyValueStore interface {
 	Set(string, []byte) error
-	Get(string, func(cursor.Cursor) ([]byte, error)) []byte
-	Del(string) bool
-	Keys() []string
-	Flush()
+	Get(string, func(cursor.Cursor) ([]byte, error)) ([]byte, error)
+	Del(string) error
+	Patch(string, int64, []byte) error
+	Append(string, []byte) error
+	SetWithTTL(string, []byte, time.Duration) error
+	Expire(string, time.Duration) error
+	TTL(string) (time.Duration, error)
+	GetWithVersion(string, func(cursor.Cursor) ([]byte, error)) ([]byte, uint64, error)
+	CompareAndSwap(string, uint64, []byte) (uint64, error)
+	SetIfAbsent(string, []byte) (uint64, error)
+	SetIfExists(string, []byte) (uint64, error)
+	DeleteIfVersion(string, uint64) error
+	Write(*WriteBatch) error
+	Begin() (*Txn, error)
+	Snapshot() (*Snapshot, error)
+	SetReader(string, io.Reader, int64) error
+	GetTo(string, io.Writer) (int64, error)
+	Open(string) (io.ReadSeekCloser, error)
+	Keys() ([]string, error)
+	Flush() error
 	Search(context.Context, func(value []byte) bool) ([][]byte, error)
+	Compact(context.Context) error
+	Reencrypt(context.Context) error
+	Close() error
 }
 
-func New(rootPath string, cacheSize int, filesCount int) KeyValueStore {
+func New(rootPath string, cacheSize int, filesCount int, opts ...Option) (KeyValueStore, error) {
 	s := new(storage)
+	s.options = defaultOptions()
+
+	for _, opt := range opts {
+		opt(&s.options)
+	}
+
+	dirLock, err := lockDirectory(rootPath, s.options.readOnly)
+	if err != nil {
+		return nil, err
+	}
+
+	s.compactor = newCompactor(s.options.compactionConcurrency)
+
+	fileOptions := append(s.options.fileOptions, filestore.WithCompactionTrigger(s.compactor.schedule))
+	if s.options.compactionRateLimit > 0 {
+		fileOptions = append(fileOptions, filestore.WithCompactionRateLimiter(newRateLimiter(s.options.compactionRateLimit)))
+	}
+
+	fileStores, err := createFileStores(rootPath, filesCount, fileOptions)
+	if err != nil {
+		s.compactor.close()
+		unlockDirectory(dirLock)
+		return nil, err
+	}
 
 	s.rootPath = rootPath
+	s.dirLock = dirLock
 	s.aolPath = filepath.Join(rootPath, aolFilename+fileExtension)
+	s.batchLogPath = filepath.Join(rootPath, batchLogFilename+fileExtension)
 	s.lruCache = lrucache.New(cacheSize)
-	s.fileStores = createFileStores(s.rootPath, filesCount)
+	s.fileStores = fileStores
 	s.filesRing, _ = consistent.New(100000)
 
 	for filename := range s.fileStores {
 		(s.filesRing).AddMember(filename)
 	}
 
-	return s
+	// Batch interrupted by a crash is completed before the store is used,
+	// read-only stores may see part of it
+	if !s.options.readOnly {
+		if err = s.recoverBatch(); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+
+	return s, nil
 }
 
 func (s *storage) Set(key string, value []byte) error {
-	s.appendToLog("SET", key, value)
+	if s.isClosed() {
+		return ErrClosed
+	}
+
+	if s.options.readOnly {
+		return ErrReadOnly
+	}
+
+	if err := s.lockWrites(); err != nil {
+		return err
+	}
+	defer s.batchLock.RUnlock()
 
 	filename := s.filesRing.GetMemberForKey(key)
 	fileStore := s.fileStores[filename]
 
-	cacheValue := s.lruCache.Get(key)
-	if equals(cacheValue, value) {
-		return nil
+	if err := s.appendToLog("SET", key, value); err != nil {
+		return err
+	}
+
+	// The value is cached only after it is stored so invalid values never reach the cache
+	if err := fileStore.Set(key, value); err != nil {
+		return err
 	}
 
 	s.lruCache.Push(key, value)
-	err := fileStore.Set(key, value)
-	return err
+	return nil
 }
 
 // get key from storage, specify valueReader to read only specific section from the value
-// or nil for the full value
-func (s *storage) Get(key string, valueReader func(cursor.Cursor) ([]byte, error)) []byte {
+// or nil for the full value, returns ErrNotFound when the key does not exist.
+// Results of valueReader are partial values and values of keys with ttl may expire so they are never cached.
+func (s *storage) Get(key string, valueReader func(cursor.Cursor) ([]byte, error)) ([]byte, error) {
+	if s.isClosed() {
+		return nil, ErrClosed
+	}
+
 	value := s.lruCache.Get(key)
 	if value != nil {
-		return value
+		if valueReader != nil {
+			return valueReader(cursor.New(bytes.NewReader(value), 0, int64(len(value))))
+		}
+
+		return value, nil
 	}
 
 	filename := s.filesRing.GetMemberForKey(key)
 	fileStore := s.fileStores[filename]
 
-	value, _ = fileStore.Get(key, valueReader)
+	value, ttl, err := fileStore.GetWithTTL(key, valueReader)
+	if err != nil || valueReader != nil || ttl != 0 {
+		return value, err
+	}
+
 	s.lruCache.Push(key, value)
 
-	return value
+	return value, nil
 }
 
-func (s *storage) Del(key string) bool {
-	s.appendToLog("DEL", key, nil)
+// Delete key from storage, returns ErrNotFound when the key does not exist
+func (s *storage) Del(key string) error {
+	if s.isClosed() {
+		return ErrClosed
+	}
+
+	if s.options.readOnly {
+		return ErrReadOnly
+	}
+
+	if err := s.lockWrites(); err != nil {
+		return err
+	}
+	defer s.batchLock.RUnlock()
+
+	if err := s.appendToLog("DEL", key, nil); err != nil {
+		return err
+	}
 
 	filename := s.filesRing.GetMemberForKey(key)
 	fileStore := s.fileStores[filename]
 
 	s.lruCache.Del(key)
-	err := fileStore.Del(key)
 
-	return err == nil
+	return fileStore.Del(key)
+}
+
+// Change the bytes of the value of key starting at offset, the value is extended when the data goes beyond its end
+func (s *storage) Patch(key string, offset int64, data []byte) error {
+	if s.isClosed() {
+		return ErrClosed
+	}
+
+	if s.options.readOnly {
+		return ErrReadOnly
+	}
+
+	if err := s.lockWrites(); err != nil {
+		return err
+	}
+	defer s.batchLock.RUnlock()
+
+	if err := s.appendToLog("PATCH", key, data); err != nil {
+		return err
+	}
+
+	filename := s.filesRing.GetMemberForKey(key)
+	fileStore := s.fileStores[filename]
+
+	// The cached value is dropped even when the patch fails since the patch may be on disk
+	defer s.lruCache.Del(key)
+
+	return fileStore.Patch(key, offset, data)
+}
+
+// Append data to the value of key atomically, a key that doesn't exist is set to data
+func (s *storage) Append(key string, data []byte) error {
+	if s.isClosed() {
+		return ErrClosed
+	}
+
+	if s.options.readOnly {
+		return ErrReadOnly
+	}
+
+	if err := s.lockWrites(); err != nil {
+		return err
+	}
+	defer s.batchLock.RUnlock()
+
+	if err := s.appendToLog("APPEND", key, data); err != nil {
+		return err
+	}
+
+	filename := s.filesRing.GetMemberForKey(key)
+	fileStore := s.fileStores[filename]
+
+	if err := fileStore.Append(key, data); err != nil {
+		return err
+	}
+
+	s.lruCache.Del(key)
+	return nil
+}
+
+// Store key value that expires after ttl, expired keys are not returned by any operation
+// and are deleted from the files in the background
+func (s *storage) SetWithTTL(key string, value []byte, ttl time.Duration) error {
+	if s.isClosed() {
+		return ErrClosed
+	}
+
+	if s.options.readOnly {
+		return ErrReadOnly
+	}
+
+	if err := s.lockWrites(); err != nil {
+		return err
+	}
+	defer s.batchLock.RUnlock()
+
+	if err := s.appendToLog("SETTTL", key, value); err != nil {
+		return err
+	}
+
+	filename := s.filesRing.GetMemberForKey(key)
+	fileStore := s.fileStores[filename]
+
+	if err := fileStore.SetWithTTL(key, value, ttl); err != nil {
+		return err
+	}
+
+	s.lruCache.Del(key)
+	return nil
+}
+
+// Set existing key to expire after ttl
+func (s *storage) Expire(key string, ttl time.Duration) error {
+	if s.isClosed() {
+		return ErrClosed
+	}
+
+	if s.options.readOnly {
+		return ErrReadOnly
+	}
+
+	if err := s.lockWrites(); err != nil {
+		return err
+	}
+	defer s.batchLock.RUnlock()
+
+	if err := s.appendToLog("EXPIRE", key, nil); err != nil {
+		return err
+	}
+
+	filename := s.filesRing.GetMemberForKey(key)
+	fileStore := s.fileStores[filename]
+
+	if err := fileStore.Expire(key, ttl); err != nil {
+		return err
+	}
+
+	s.lruCache.Del(key)
+	return nil
+}
+
+// Remaining time to live of key, 0 for keys that never expire
+func (s *storage) TTL(key string) (time.Duration, error) {
+	if s.isClosed() {
+		return 0, ErrClosed
+	}
+
+	filename := s.filesRing.GetMemberForKey(key)
+	fileStore := s.fileStores[filename]
+
+	return fileStore.TTL(key)
+}
+
+// Get value of key with its version, the value is read from the file since the cache has no versions
+func (s *storage) GetWithVersion(key string, valueReader func(cursor.Cursor) ([]byte, error)) ([]byte, uint64, error) {
+	if s.isClosed() {
+		return nil, 0, ErrClosed
+	}
+
+	filename := s.filesRing.GetMemberForKey(key)
+	fileStore := s.fileStores[filename]
+
+	return fileStore.GetWithVersion(key, valueReader)
+}
+
+// Set key value only when the key version is expectedVersion and return the new version
+func (s *storage) CompareAndSwap(key string, expectedVersion uint64, value []byte) (uint64, error) {
+	return s.setIf("CAS", key, value, func(fileStore *filestore.FileKeyValueStore) (uint64, error) {
+		return fileStore.CompareAndSwap(key, expectedVersion, value)
+	})
 }
 
-func (s *storage) Keys() []string {
+// Set key value only when the key doesn't exist and return the new version
+func (s *storage) SetIfAbsent(key string, value []byte) (uint64, error) {
+	return s.setIf("SETIFABSENT", key, value, func(fileStore *filestore.FileKeyValueStore) (uint64, error) {
+		return fileStore.SetIfAbsent(key, value)
+	})
+}
+
+// Set key value only when the key exists and return the new version
+func (s *storage) SetIfExists(key string, value []byte) (uint64, error) {
+	return s.setIf("SETIFEXISTS", key, value, func(fileStore *filestore.FileKeyValueStore) (uint64, error) {
+		return fileStore.SetIfExists(key, value)
+	})
+}
+
+// Conditional set of key in the file that owns the key, the value is cached only when it was stored
+func (s *storage) setIf(cmd string, key string, value []byte, set func(*filestore.FileKeyValueStore) (uint64, error)) (uint64, error) {
+	if s.isClosed() {
+		return 0, ErrClosed
+	}
+
+	if s.options.readOnly {
+		return 0, ErrReadOnly
+	}
+
+	if err := s.lockWrites(); err != nil {
+		return 0, err
+	}
+	defer s.batchLock.RUnlock()
+
+	if err := s.appendToLog(cmd, key, value); err != nil {
+		return 0, err
+	}
+
+	filename := s.filesRing.GetMemberForKey(key)
+	fileStore := s.fileStores[filename]
+
+	version, err := set(fileStore)
+	if err != nil {
+		return 0, err
+	}
+
+	s.lruCache.Push(key, value)
+	return version, nil
+}
+
+// Delete key only when the key version is version
+func (s *storage) DeleteIfVersion(key string, version uint64) error {
+	if s.isClosed() {
+		return ErrClosed
+	}
+
+	if s.options.readOnly {
+		return ErrReadOnly
+	}
+
+	if err := s.lockWrites(); err != nil {
+		return err
+	}
+	defer s.batchLock.RUnlock()
+
+	if err := s.appendToLog("DELIFVERSION", key, nil); err != nil {
+		return err
+	}
+
+	filename := s.filesRing.GetMemberForKey(key)
+	fileStore := s.fileStores[filename]
+
+	s.lruCache.Del(key)
+
+	return fileStore.DeleteIfVersion(key, version)
+}
+
+// Store value of size bytes read from r, the value is streamed to the file and not cached
+func (s *storage) SetReader(key string, r io.Reader, size int64) error {
+	if s.isClosed() {
+		return ErrClosed
+	}
+
+	if s.options.readOnly {
+		return ErrReadOnly
+	}
+
+	if err := s.lockWrites(); err != nil {
+		return err
+	}
+	defer s.batchLock.RUnlock()
+
+	if err := s.appendToLog("SETREADER", key, nil); err != nil {
+		return err
+	}
+
+	filename := s.filesRing.GetMemberForKey(key)
+	fileStore := s.fileStores[filename]
+
+	if err := fileStore.SetReader(key, r, size); err != nil {
+		return err
+	}
+
+	s.lruCache.Del(key)
+	return nil
+}
+
+// Write value of key to w, values that are not cached are streamed from the file without being cached
+func (s *storage) GetTo(key string, w io.Writer) (int64, error) {
+	if s.isClosed() {
+		return 0, ErrClosed
+	}
+
+	if value := s.lruCache.Get(key); value != nil {
+		n, err := w.Write(value)
+		return int64(n), err
+	}
+
+	filename := s.filesRing.GetMemberForKey(key)
+	fileStore := s.fileStores[filename]
+
+	return fileStore.GetTo(key, w)
+}
+
+// Open value of key for streaming reads from the file, the value is not cached
+func (s *storage) Open(key string) (io.ReadSeekCloser, error) {
+	if s.isClosed() {
+		return nil, ErrClosed
+	}
+
+	filename := s.filesRing.GetMemberForKey(key)
+	fileStore := s.fileStores[filename]
+
+	return fileStore.Open(key)
+}
+
+func (s *storage) Keys() ([]string, error) {
+	if s.isClosed() {
+		return nil, ErrClosed
+	}
+
 	keys := make([]string, 0, 10000)
 
 	for _, filestore := range s.fileStores {
 		keys = append(keys, filestore.Keys()...)
 	}
 
-	return keys
+	return keys, nil
 }
 
-// Delete all files and clear all RAM data
-func (s *storage) Flush() {
+// Delete all files and clear all RAM data, returns ErrSnapshotOpen while snapshots are open
+func (s *storage) Flush() error {
+	if s.isClosed() {
+		return ErrClosed
+	}
+
+	if s.options.readOnly {
+		return ErrReadOnly
+	}
+
+	if err := s.lockWrites(); err != nil {
+		return err
+	}
+	defer s.batchLock.RUnlock()
+
+	// Snapshots are created only while no writes run so no snapshot is opened during the flush
+	if atomic.LoadInt32(&s.snapshots) > 0 {
+		return ErrSnapshotOpen
+	}
+
 	if toggleAOL {
 		s.aolLock.Lock()
 		defer s.aolLock.Unlock()
@@ -120,21 +535,35 @@ func (s *storage) Flush() {
 	s.lruCache.Clear()
 
 	var wg sync.WaitGroup
+	errs := make(chan error, len(s.fileStores))
 
 	for _, fs := range s.fileStores {
 		wg.Add(1)
 
 		go func(fs *filestore.FileKeyValueStore) {
-			fs.Flush()
+			errs <- fs.Flush()
 			wg.Done()
 		}(fs)
 	}
 
 	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 // scan all the values in the store and filter them with the 'evaluate' function
 func (s *storage) Search(ctx context.Context, evaluate func(value []byte) bool) ([][]byte, error) {
+	if s.isClosed() {
+		return nil, ErrClosed
+	}
+
 	results := make([][]byte, 0, 1000)
 	for _, fs := range s.fileStores {
 		fsResults, err := fs.Search(ctx, evaluate)
@@ -147,3 +576,57 @@ func (s *storage) Search(ctx context.Context, evaluate func(value []byte) bool)
 
 	return results, nil
 }
+
+// Compact the segments with many deleted items in all the files and wait for the compaction to finish,
+// the items that open snapshots read are kept
+func (s *storage) Compact(ctx context.Context) error {
+	if s.isClosed() {
+		return ErrClosed
+	}
+
+	return s.compactor.compactAll(ctx, s.fileStores)
+}
+
+// Rewrite all the files with the current encryption key, used after key rotation
+func (s *storage) Reencrypt(ctx context.Context) error {
+	if s.isClosed() {
+		return ErrClosed
+	}
+
+	for _, fs := range s.fileStores {
+		if err := fs.Reencrypt(ctx); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Close all the files, the keys index of every file is saved for fast loading on the next open
+func (s *storage) Close() error {
+	if !atomic.CompareAndSwapInt32(&s.closed, 0, 1) {
+		return ErrClosed
+	}
+
+	s.compactor.close()
+
+	var closeErr error
+
+	for _, fs := range s.fileStores {
+		if err := fs.Close(); err != nil && closeErr == nil {
+			closeErr = err
+		}
+	}
+
+	// The lock is released only after all the files are closed
+	if err := unlockDirectory(s.dirLock); err != nil && closeErr == nil {
+		closeErr = err
+	}
+	s.dirLock = nil
+
+	return closeErr
+}
+
+func (s *storage) isClosed() bool {
+	return atomic.LoadInt32(&s.closed) == 1
+}
@@ -1,10 +1,22 @@
 package engine
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"io"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/lokidb/engine/v2/cursor"
+	"github.com/lokidb/engine/v2/encryption"
+	filestore "github.com/lokidb/engine/v2/file_storage"
 )
 
 func equal(a, b []byte) bool {
@@ -23,46 +35,67 @@ func equal(a, b []byte) bool {
 
 func TestValidation(t *testing.T) {
 	t.Cleanup(func() {
+		os.Remove(lockFilename)
+		os.Remove(batchLogFilename + fileExtension)
 		os.Remove("ldb-0.loki")
+		os.Remove("ldb-0.loki.hint")
 	})
 
-	engine := New("./", 0, 1)
+	engine, err := New("./", 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engine.Close()
 
-	err := engine.Set("", []byte("abc"))
-	if err == nil {
-		t.Errorf("expecting validation check to return an error")
+	err = engine.Set("", []byte("abc"))
+	if !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("expecting validation check to return ErrInvalidKey not %v", err)
 	}
 
 	err = engine.Set("abc", []byte(""))
-	if err == nil {
-		t.Errorf("expecting validation check to return an error")
+	if !errors.Is(err, ErrInvalidValue) {
+		t.Errorf("expecting validation check to return ErrInvalidValue not %v", err)
 	}
 
-	val := engine.Get("", nil)
-	if val != nil {
-		t.Errorf("expecting to get nil for invalid key")
+	val, err := engine.Get("", nil)
+	if val != nil || !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("expecting to get ErrInvalidKey for invalid key")
 	}
 }
 
 func TestGetNonExisting(t *testing.T) {
 	t.Cleanup(func() {
+		os.Remove(lockFilename)
+		os.Remove(batchLogFilename + fileExtension)
 		os.Remove("ldb-0.loki")
+		os.Remove("ldb-0.loki.hint")
 	})
 
-	engine := New("./", 0, 1)
-
-	err := engine.Get("a", nil)
+	engine, err := New("./", 0, 1)
 	if err != nil {
-		t.Errorf("expecting to get nil for non existing key")
+		t.Fatal(err)
+	}
+	defer engine.Close()
+
+	value, err := engine.Get("a", nil)
+	if value != nil || !errors.Is(err, ErrNotFound) {
+		t.Errorf("expecting to get ErrNotFound for non existing key not %v", err)
 	}
 }
 
 func TestEngine(t *testing.T) {
 	t.Cleanup(func() {
+		os.Remove(lockFilename)
+		os.Remove(batchLogFilename + fileExtension)
 		os.Remove("ldb-0.loki")
+		os.Remove("ldb-0.loki.hint")
 	})
 
-	engine := New("./", 0, 1)
+	engine, err := New("./", 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engine.Close()
 
 	ValidKeyValue := map[string][]byte{
 		"a":   []byte("b"),
@@ -76,18 +109,18 @@ func TestEngine(t *testing.T) {
 				t.Fatalf("setting value %s for key %s should be valid", value, key)
 			}
 
-			retValue := engine.Get(key, nil)
-			if !equal(retValue, value) {
+			retValue, err := engine.Get(key, nil)
+			if err != nil || !equal(retValue, value) {
 				t.Fatalf("return value from engine for key %s must be %s and not %s", key, value, retValue)
 			}
 
-			deleted := engine.Del(key)
-			if !deleted {
+			err = engine.Del(key)
+			if err != nil {
 				t.Fatalf("key %s is exists and shoule be deleted", key)
 			}
 
-			retValue = engine.Get(key, nil)
-			if retValue != nil {
+			retValue, err = engine.Get(key, nil)
+			if retValue != nil || !errors.Is(err, ErrNotFound) {
 				t.Fatalf("return value from engine for deleted key %s must be nil not %s", key, retValue)
 			}
 		})
@@ -110,27 +143,38 @@ func TestEngine(t *testing.T) {
 
 func TestDelete(t *testing.T) {
 	t.Cleanup(func() {
+		os.Remove(lockFilename)
+		os.Remove(batchLogFilename + fileExtension)
 		os.Remove("ldb-0.loki")
+		os.Remove("ldb-0.loki.hint")
 	})
 
-	engine := New("./", 0, 1)
+	engine, err := New("./", 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engine.Close()
 
-	err := engine.Set("key", []byte("value"))
+	err = engine.Set("key", []byte("value"))
 	if err != nil {
 		t.Error(err)
 	}
 
-	value := engine.Get("key", nil)
-	if !equal(value, []byte("value")) {
+	value, err := engine.Get("key", nil)
+	if err != nil || !equal(value, []byte("value")) {
 		t.Errorf("expecting value to be equal to 'value'")
 	}
 
-	deleted := engine.Del("key")
-	if !deleted {
+	err = engine.Del("key")
+	if err != nil {
 		t.Errorf("expecting key to be deleted")
 	}
 
-	value = engine.Get("key", nil)
+	if err = engine.Del("key"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expecting ErrNotFound for deleting missing key not %v", err)
+	}
+
+	value, _ = engine.Get("key", nil)
 	if value != nil {
 		t.Errorf("expecting value to be equal to nil after key deleted")
 	}
@@ -138,51 +182,81 @@ func TestDelete(t *testing.T) {
 
 func TestUseDiskData(t *testing.T) {
 	t.Cleanup(func() {
+		os.Remove(lockFilename)
+		os.Remove(batchLogFilename + fileExtension)
 		os.Remove("ldb-0.loki")
+		os.Remove("ldb-0.loki.hint")
 	})
 
-	db := New("./", 1000, 1)
+	db, err := New("./", 1000, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
 	db.Set("abc", []byte("abc"))
 	db.Set("abc4", []byte("abc4"))
 	db.Del("abc4")
+	db.Close()
 
-	db2 := New("./", 1000, 1)
-	if !equal(db2.Get("abc", nil), []byte("abc")) {
+	db2, err := New("./", 1000, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db2.Close()
+	if value, _ := db2.Get("abc", nil); !equal(value, []byte("abc")) {
 		t.Errorf("cant use loaded data")
 	}
-	if equal(db2.Get("abc4", nil), []byte("abc4")) {
+	if value, _ := db2.Get("abc4", nil); equal(value, []byte("abc4")) {
 		t.Errorf("loaded data is loading deleted keys")
 	}
 }
 
 func TestKeys(t *testing.T) {
 	t.Cleanup(func() {
+		os.Remove(lockFilename)
+		os.Remove(batchLogFilename + fileExtension)
 		os.Remove("ldb-0.loki")
+		os.Remove("ldb-0.loki.hint")
 		os.Remove("ldb-1.loki")
+		os.Remove("ldb-1.loki.hint")
 	})
 
-	db := New("./", 0, 2)
+	db, err := New("./", 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
 
 	for i := 0; i < 1000; i++ {
 		db.Set(strconv.Itoa(i), []byte("valuevalue"))
 	}
 
-	keys := db.Keys()
-	if len(keys) != 1000 {
+	keys, err := db.Keys()
+	if err != nil || len(keys) != 1000 {
 		t.Error("expecting length of keys to be 1000")
 	}
 }
 
 func TestSearch(t *testing.T) {
 	t.Cleanup(func() {
+		os.Remove(lockFilename)
+		os.Remove(batchLogFilename + fileExtension)
 		os.Remove("ldb-0.loki")
+		os.Remove("ldb-0.loki.hint")
 		os.Remove("ldb-1.loki")
+		os.Remove("ldb-1.loki.hint")
 		os.Remove("ldb-2.loki")
+		os.Remove("ldb-2.loki.hint")
 		os.Remove("ldb-3.loki")
+		os.Remove("ldb-3.loki.hint")
 		os.Remove("ldb-4.loki")
+		os.Remove("ldb-4.loki.hint")
 	})
 
-	db := New("./", 100, 5)
+	db, err := New("./", 100, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
 
 	for i := 0; i < 231; i++ {
 		db.Set(strconv.Itoa(i), []byte{byte(i)})
@@ -207,14 +281,25 @@ func TestSearch(t *testing.T) {
 
 func TestOverwrite(t *testing.T) {
 	t.Cleanup(func() {
+		os.Remove(lockFilename)
+		os.Remove(batchLogFilename + fileExtension)
 		os.Remove("ldb-0.loki")
+		os.Remove("ldb-0.loki.hint")
 		os.Remove("ldb-1.loki")
+		os.Remove("ldb-1.loki.hint")
 		os.Remove("ldb-2.loki")
+		os.Remove("ldb-2.loki.hint")
 		os.Remove("ldb-3.loki")
+		os.Remove("ldb-3.loki.hint")
 		os.Remove("ldb-4.loki")
+		os.Remove("ldb-4.loki.hint")
 	})
 
-	db := New("./", 100, 5)
+	db, err := New("./", 100, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
 
 	db.Set("abc", []byte("b0123456789"))
 
@@ -222,8 +307,765 @@ func TestOverwrite(t *testing.T) {
 
 	db.Set("abc", []byte("0123456789"))
 
-	value := db.Get("abc", nil)
+	value, _ := db.Get("abc", nil)
 	if !equal(value, []byte("0123456789")) {
 		t.Error("expecting key 'abc' to be overwriten")
 	}
 }
+
+func TestCompact(t *testing.T) {
+	dir := t.TempDir()
+
+	db, err := New(dir, 0, 2, WithCompactionConcurrency(2), WithCompactionRateLimit(1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	value := bytes.Repeat([]byte("v"), 100)
+	for i := 0; i < 200; i++ {
+		db.Set(strconv.Itoa(i), value)
+	}
+
+	for i := 0; i < 150; i++ {
+		db.Del(strconv.Itoa(i))
+	}
+
+	if err = db.Compact(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	var totalSize int64
+	for _, filename := range []string{"ldb-0.loki", "ldb-1.loki"} {
+		fileInfo, err := os.Stat(filepath.Join(dir, filename))
+		if err != nil {
+			t.Fatal(err)
+		}
+		totalSize += fileInfo.Size()
+	}
+
+	if totalSize > 50*123+100 {
+		t.Errorf("expecting deleted items to be removed by compaction, files size is %d", totalSize)
+	}
+
+	if stored, _ := db.Get("199", nil); !equal(stored, value) {
+		t.Error("expecting value to be readable after compaction")
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	dir := t.TempDir()
+
+	keyRing, err := encryption.NewKeyRing(1, bytes.Repeat([]byte{7}, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := New(dir, 0, 2, WithEncryption(keyRing, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Set("customer", []byte("private data"))
+
+	if keys, _ := db.Keys(); len(keys) != 1 || keys[0] != "customer" {
+		t.Error("expecting keys to be decrypted")
+	}
+
+	results, err := db.Search(context.Background(), func(value []byte) bool {
+		return bytes.Contains(value, []byte("private"))
+	})
+	if err != nil || len(results) != 1 {
+		t.Error("expecting search to work on encrypted files")
+	}
+
+	for _, filename := range []string{"ldb-0.loki", "ldb-1.loki"} {
+		content, _ := os.ReadFile(filepath.Join(dir, filename))
+		if bytes.Contains(content, []byte("customer")) || bytes.Contains(content, []byte("private")) {
+			t.Errorf("expecting %s to not contain plaintext", filename)
+		}
+	}
+}
+
+func TestSyncAlways(t *testing.T) {
+	dir := t.TempDir()
+
+	db, err := New(dir, 0, 2, WithSyncPolicy(filestore.SyncAlways, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := db.Set(strconv.Itoa(i), []byte("value")); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	db.Close()
+
+	db, err = New(dir, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if keys, _ := db.Keys(); len(keys) != 20 {
+		t.Error("expecting all the synced writes to be stored")
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	dir := t.TempDir()
+
+	db, err := New(dir, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Set("a", []byte("1"))
+	db.Close()
+
+	db, err = New(dir, 0, 2, WithReadOnly(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if value, _ := db.Get("a", nil); string(value) != "1" {
+		t.Errorf("expecting value '1' not %s", value)
+	}
+
+	if err = db.Set("b", []byte("2")); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("expecting Set to return ErrReadOnly not %v", err)
+	}
+
+	if err = db.Del("a"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("expecting Del to return ErrReadOnly not %v", err)
+	}
+
+	if err = db.Flush(); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("expecting Flush to return ErrReadOnly not %v", err)
+	}
+
+	if value, _ := db.Get("b", nil); value != nil {
+		t.Error("expecting rejected write not to be cached")
+	}
+}
+
+func TestDirectoryLock(t *testing.T) {
+	dir := t.TempDir()
+
+	db, err := New(dir, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = New(dir, 0, 2); !errors.Is(err, ErrLocked) {
+		t.Errorf("expecting second open to return ErrLocked not %v", err)
+	}
+
+	if _, err = New(dir, 0, 2, WithReadOnly(true)); !errors.Is(err, ErrLocked) {
+		t.Errorf("expecting read-only open of locked store to return ErrLocked not %v", err)
+	}
+	db.Close()
+
+	reader, err := New(dir, 0, 2, WithReadOnly(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := New(dir, 0, 2, WithReadOnly(true))
+	if err != nil {
+		t.Errorf("expecting read-only stores to share the lock, got %v", err)
+	} else {
+		other.Close()
+	}
+
+	if _, err = New(dir, 0, 2); !errors.Is(err, ErrLocked) {
+		t.Errorf("expecting writer open while read-only store is open to return ErrLocked not %v", err)
+	}
+	reader.Close()
+
+	db, err = New(dir, 0, 2)
+	if err != nil {
+		t.Fatalf("expecting lock to be released on close, got %v", err)
+	}
+	db.Close()
+}
+
+func TestOpenFailure(t *testing.T) {
+	dir := t.TempDir()
+
+	// The second file can't be opened, the first one is closed again
+	if err := os.Mkdir(filepath.Join(dir, filePrefix+"1"+fileExtension), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := New(dir, 0, 2); err == nil {
+		t.Fatal("expecting error when a file can't be opened")
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, filePrefix+"0"+fileExtension+".hint")); err != nil {
+		t.Errorf("expecting opened file to be closed, %v", err)
+	}
+}
+
+func TestClosed(t *testing.T) {
+	db, err := New(t.TempDir(), 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.Set("a", []byte("1"))
+	db.Close()
+
+	if _, err = db.Get("a", nil); !errors.Is(err, ErrClosed) {
+		t.Errorf("expecting Get to return ErrClosed not %v", err)
+	}
+
+	if err = db.Set("a", []byte("2")); !errors.Is(err, ErrClosed) {
+		t.Errorf("expecting Set to return ErrClosed not %v", err)
+	}
+
+	if err = db.Close(); !errors.Is(err, ErrClosed) {
+		t.Errorf("expecting second Close to return ErrClosed not %v", err)
+	}
+}
+
+func TestStreaming(t *testing.T) {
+	db, err := New(t.TempDir(), 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	value := bytes.Repeat([]byte("0123456789"), 100000)
+
+	db.Set("file", []byte("old"))
+	db.Get("file", nil)
+
+	if err = db.SetReader("file", bytes.NewReader(value), int64(len(value))); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if _, err = db.GetTo("file", &buf); err != nil || !bytes.Equal(buf.Bytes(), value) {
+		t.Errorf("expecting streamed value not the cached value, got error %v", err)
+	}
+
+	reader, err := db.Open("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	part := make([]byte, 5)
+	reader.Seek(15, io.SeekStart)
+	if _, err = io.ReadFull(reader, part); err != nil || string(part) != "56789" {
+		t.Errorf("expecting to read part of the value, got %s", part)
+	}
+}
+
+func TestPartialGet(t *testing.T) {
+	dir := t.TempDir()
+
+	db, err := New(dir, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.Set("key", []byte("0123456789"))
+	db.Close()
+
+	db, err = New(dir, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	readPart := func(c cursor.Cursor) ([]byte, error) {
+		part := make([]byte, 3)
+		_, err := c.ReadAt(part, 4)
+		return part, err
+	}
+
+	part, err := db.Get("key", readPart)
+	if err != nil || string(part) != "456" {
+		t.Errorf("expecting partial value '456' not %s", part)
+	}
+
+	if value, _ := db.Get("key", nil); string(value) != "0123456789" {
+		t.Errorf("expecting partial value not to be cached, got %s", value)
+	}
+
+	if part, _ = db.Get("key", readPart); string(part) != "456" {
+		t.Errorf("expecting partial read of cached value '456' not %s", part)
+	}
+}
+
+func TestPatch(t *testing.T) {
+	db, err := New(t.TempDir(), 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Set("key", []byte("0123456789"))
+	db.Get("key", nil)
+
+	if err = db.Patch("key", 8, []byte("ab")); err != nil {
+		t.Fatal(err)
+	}
+
+	if value, _ := db.Get("key", nil); string(value) != "01234567ab" {
+		t.Errorf("expecting cached value to be updated, got %s", value)
+	}
+
+	if err = db.Patch("key", 9, []byte("xyz")); err != nil {
+		t.Fatal(err)
+	}
+
+	if value, _ := db.Get("key", nil); string(value) != "01234567axyz" {
+		t.Errorf("expecting extended value, got %s", value)
+	}
+}
+
+func TestAppend(t *testing.T) {
+	db, err := New(t.TempDir(), 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Set("events", []byte("a"))
+	db.Get("events", nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := db.Append("events", []byte("b")); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if value, _ := db.Get("events", nil); string(value) != "a"+strings.Repeat("b", 20) {
+		t.Errorf("expecting all the appends in the value, got %s", value)
+	}
+}
+
+func TestTTL(t *testing.T) {
+	db, err := New(t.TempDir(), 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Set("session", []byte("value"))
+	db.Get("session", nil)
+
+	if err = db.Expire("session", 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.Expire("missing", time.Second); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expecting ErrNotFound for expire of missing key, got %v", err)
+	}
+
+	if value, _ := db.Get("session", nil); string(value) != "value" {
+		t.Errorf("expecting value before expiry not %s", value)
+	}
+
+	if ttl, err := db.TTL("session"); err != nil || ttl <= 0 {
+		t.Errorf("expecting positive ttl, got %v %v", ttl, err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	// The value read before the expiry is not served from the cache
+	if _, err = db.Get("session", nil); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expecting ErrNotFound for expired key, got %v", err)
+	}
+
+	if err = db.SetWithTTL("token", []byte("value"), -time.Second); !errors.Is(err, ErrInvalidTTL) {
+		t.Errorf("expecting ErrInvalidTTL for negative ttl, got %v", err)
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	db, err := New(t.TempDir(), 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	version, err := db.SetIfAbsent("key", []byte("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = db.SetIfAbsent("key", []byte("b")); !errors.Is(err, ErrKeyExists) {
+		t.Errorf("expecting ErrKeyExists, got %v", err)
+	}
+
+	if _, err = db.CompareAndSwap("key", version, []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The cached value is replaced only by successful writes
+	if _, err = db.CompareAndSwap("key", version, []byte("c")); !errors.Is(err, ErrVersionMismatch) {
+		t.Errorf("expecting ErrVersionMismatch, got %v", err)
+	}
+
+	if value, _ := db.Get("key", nil); string(value) != "b" {
+		t.Errorf("expecting swapped value 'b' not %s", value)
+	}
+
+	// Setting the same value is a write that changes the version
+	_, version, _ = db.GetWithVersion("key", nil)
+	db.Set("key", []byte("b"))
+	if _, err = db.CompareAndSwap("key", version, []byte("c")); !errors.Is(err, ErrVersionMismatch) {
+		t.Errorf("expecting ErrVersionMismatch after setting the same value, got %v", err)
+	}
+
+	_, version, _ = db.GetWithVersion("key", nil)
+	if err = db.DeleteIfVersion("key", version); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = db.SetIfExists("key", []byte("d")); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expecting ErrNotFound after delete, got %v", err)
+	}
+}
+
+func TestWriteBatch(t *testing.T) {
+	dir := t.TempDir()
+
+	db, err := New(dir, 10, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.Set("old", []byte("value"))
+	db.Get("old", nil)
+
+	batch := NewWriteBatch()
+	for i := 0; i < 20; i++ {
+		batch.Set("key"+strconv.Itoa(i), []byte("value"))
+	}
+	batch.Del("old")
+	batch.Del("missing")
+
+	if err = db.Write(batch); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, _ := db.Keys()
+	if len(keys) != 20 {
+		t.Errorf("expecting 20 keys after batch, got %d", len(keys))
+	}
+
+	if _, err = db.Get("old", nil); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expecting cached key deleted by batch to be not found, got %v", err)
+	}
+
+	// Invalid writes reject the whole batch
+	batch.Reset()
+	batch.Set("new", []byte("value"))
+	batch.Set("", []byte("value"))
+
+	if err = db.Write(batch); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("expecting ErrInvalidKey, got %v", err)
+	}
+
+	if _, err = db.Get("new", nil); !errors.Is(err, ErrNotFound) {
+		t.Error("expecting rejected batch not to be written")
+	}
+	db.Close()
+
+	// Batch left in the log by a crash is applied on open and incomplete batch is discarded
+	batchLogPath := filepath.Join(dir, batchLogFilename+fileExtension)
+	for _, complete := range []bool{true, false} {
+		key := "crash-" + strconv.FormatBool(complete)
+		content, _ := encodeBatch([]filestore.BatchOp{{Key: "key0", Delete: true}, {Key: key, Value: []byte("value")}}, nil)
+		if !complete {
+			content = content[:len(content)-1]
+		}
+		os.WriteFile(batchLogPath, content, 0600)
+
+		db, err = New(dir, 10, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = db.Get(key, nil)
+		if complete && err != nil {
+			t.Errorf("expecting batch from the log to be applied, got %v", err)
+		} else if !complete && !errors.Is(err, ErrNotFound) {
+			t.Errorf("expecting incomplete batch to be discarded, got %v", err)
+		}
+
+		if content, _ = os.ReadFile(batchLogPath); len(content) != 0 {
+			t.Error("expecting empty batch log after open")
+		}
+
+		db.Close()
+	}
+
+	// Batch that failed to apply is applied again before later writes
+	db, err = New(dir, 10, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	s := db.(*storage)
+	failing, later := "failing", ""
+	for i := 0; later == ""; i++ {
+		if key := "later" + strconv.Itoa(i); s.filesRing.GetMemberForKey(key) != s.filesRing.GetMemberForKey(failing) {
+			later = key
+		}
+	}
+
+	// The batch is in the log and applying it fails on the closed file
+	filename := s.filesRing.GetMemberForKey(failing)
+	s.fileStores[filename].Close()
+
+	content, _ := encodeBatch([]filestore.BatchOp{{Key: later, Value: []byte("batch")}, {Key: failing, Value: []byte("batch")}}, nil)
+	os.WriteFile(batchLogPath, content, 0600)
+	s.batchPending = true
+
+	if err = db.Set(later, []byte("later")); !errors.Is(err, ErrClosed) {
+		t.Errorf("expecting writes to fail while the batch can't be applied, got %v", err)
+	}
+
+	// Files that applied the batch are not written again by the next attempts,
+	// the files are applied in any order so the failing file may be tried first
+	laterStore := s.fileStores[s.filesRing.GetMemberForKey(later)]
+	applied, _ := laterStore.Version(later)
+	for i := 0; applied == 0 && i < 100; i++ {
+		db.Set(later, []byte("later"))
+		applied, _ = laterStore.Version(later)
+	}
+
+	if applied == 0 {
+		t.Fatal("expecting the batch to be applied to the file that doesn't fail")
+	}
+
+	db.Set(later, []byte("later"))
+	if version, _ := laterStore.Version(later); version != applied {
+		t.Errorf("expecting batch not to be applied again to the same file, version %d became %d", applied, version)
+	}
+
+	s.fileStores[filename], err = filestore.New(filepath.Join(dir, filename))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.Set(later, []byte("later")); err != nil {
+		t.Fatal(err)
+	}
+
+	if value, _ := db.Get(later, nil); string(value) != "later" {
+		t.Errorf("expecting the write after the batch to win, got %s", value)
+	}
+
+	if value, _ := db.Get(failing, nil); string(value) != "batch" {
+		t.Errorf("expecting failed batch to be applied again, got %s", value)
+	}
+}
+
+func TestTxn(t *testing.T) {
+	db, err := New(t.TempDir(), 10, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Set("a", []byte("1"))
+	db.Set("b", []byte("1"))
+
+	t1, _ := db.Begin()
+	t1.Get("a")
+	t1.Set("b", []byte("2"))
+
+	t2, _ := db.Begin()
+	t2.Get("a")
+	t2.Set("a", []byte("3"))
+
+	if value, _ := t2.Get("a"); string(value) != "3" {
+		t.Errorf("expecting transaction to read its own write, got %s", value)
+	}
+
+	if err = t2.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = t1.Commit(); !errors.Is(err, ErrConflict) {
+		t.Errorf("expecting ErrConflict for changed read, got %v", err)
+	}
+
+	if value, _ := db.Get("b", nil); string(value) != "1" {
+		t.Errorf("expecting conflicting transaction not to write, got %s", value)
+	}
+
+	if err = t1.Commit(); !errors.Is(err, ErrTxnDone) {
+		t.Errorf("expecting ErrTxnDone for second commit, got %v", err)
+	}
+
+	// Keys that didn't exist when read conflict when they are created
+	t3, _ := db.Begin()
+	if _, err = t3.Get("c"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expecting ErrNotFound, got %v", err)
+	}
+	t3.Del("a")
+	db.Set("c", []byte("1"))
+
+	if err = t3.Commit(); !errors.Is(err, ErrConflict) {
+		t.Errorf("expecting ErrConflict for created key, got %v", err)
+	}
+
+	t4, _ := db.Begin()
+	t4.Set("d", []byte("1"))
+	t4.Rollback()
+
+	if _, err = db.Get("d", nil); !errors.Is(err, ErrNotFound) {
+		t.Error("expecting rolled back write not to be written")
+	}
+
+	// Keys are read at their version when first read, only read keys are validated
+	t5, _ := db.Begin()
+	t5.Get("a")
+	db.Set("b", []byte("changed"))
+
+	if value, _ := t5.Get("b"); string(value) != "changed" {
+		t.Errorf("expecting latest value of key first read after the write, got %s", value)
+	}
+	t5.Set("c", []byte("2"))
+
+	if err = t5.Commit(); err != nil {
+		t.Errorf("expecting commit when the read keys were not changed since read, got %v", err)
+	}
+	db.Set("b", []byte("1"))
+
+	// Concurrent read modify write transactions with retries
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				txn, _ := db.Begin()
+				a, _ := txn.Get("a")
+				b, _ := txn.Get("b")
+				n, _ := strconv.Atoi(string(a))
+				m, _ := strconv.Atoi(string(b))
+				txn.Set("a", []byte(strconv.Itoa(n+1)))
+				txn.Set("b", []byte(strconv.Itoa(m+1)))
+
+				err := txn.Commit()
+				if err == nil {
+					return
+				}
+
+				if !errors.Is(err, ErrConflict) {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	a, _ := db.Get("a", nil)
+	b, _ := db.Get("b", nil)
+	if string(a) != "13" || string(b) != "11" {
+		t.Errorf("expecting a=13 and b=11, got a=%s b=%s", a, b)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	db, err := New(t.TempDir(), 10, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 20; i++ {
+		db.Set("key"+strconv.Itoa(i), []byte("1"))
+	}
+
+	snap, err := db.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Writes after the snapshot are not seen by it
+	batch := NewWriteBatch()
+	for i := 0; i < 20; i++ {
+		batch.Set("key"+strconv.Itoa(i), []byte("2"))
+	}
+	batch.Set("new", []byte("2"))
+	db.Write(batch)
+	db.Del("key0")
+
+	if err = db.Compact(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	it, err := snap.Iterator()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []string
+	for it.Next() {
+		keys = append(keys, it.Key())
+		if string(it.Value()) != "1" {
+			t.Errorf("expecting snapshot value 1 of %s not %s", it.Key(), it.Value())
+		}
+	}
+
+	if it.Err() != nil || len(keys) != 20 || !sort.StringsAreSorted(keys) {
+		t.Errorf("expecting 20 sorted keys, got %v %v", keys, it.Err())
+	}
+
+	results, _ := snap.Search(context.Background(), func(value []byte) bool { return string(value) == "2" })
+	if len(results) != 0 {
+		t.Errorf("expecting no values written after the snapshot, got %d", len(results))
+	}
+
+	if value, _ := db.Get("key1", nil); string(value) != "2" {
+		t.Errorf("expecting store to see the new value not %s", value)
+	}
+
+	// Flush doesn't delete the files while the snapshot reads them
+	if err = db.Flush(); !errors.Is(err, ErrSnapshotOpen) {
+		t.Errorf("expecting ErrSnapshotOpen, got %v", err)
+	}
+
+	if value, _ := snap.Get("key1", nil); string(value) != "1" {
+		t.Errorf("expecting snapshot value 1 after the failed flush not %s", value)
+	}
+
+	if err = snap.Release(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = snap.Get("key1", nil); !errors.Is(err, ErrSnapshotReleased) {
+		t.Errorf("expecting ErrSnapshotReleased, got %v", err)
+	}
+
+	snap.Release()
+	if err = db.Flush(); err != nil {
+		t.Errorf("expecting flush after the snapshot is released, got %v", err)
+	}
+}
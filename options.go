@@ -0,0 +1,126 @@
+package engine
+
+import (
+	"time"
+
+	"github.com/lokidb/engine/v2/encryption"
+	filestore "github.com/lokidb/engine/v2/file_storage"
+)
+
+type options struct {
+	fileOptions           []filestore.Option
+	compactionConcurrency int
+	compactionRateLimit   int
+	keyProvider           encryption.KeyProvider
+	readOnly              bool
+}
+
+func defaultOptions() options {
+	return options{
+		compactionConcurrency: 1,
+	}
+}
+
+type Option func(*options)
+
+// Set the policy for corrupted items found while loading or reading the files
+func WithCorruptionPolicy(policy filestore.CorruptionPolicy) Option {
+	return func(o *options) {
+		o.fileOptions = append(o.fileOptions, filestore.WithCorruptionPolicy(policy))
+	}
+}
+
+// Set function that will be called for every skipped or truncated corrupted item
+func WithCorruptionReporter(reporter func(*filestore.CorruptionError)) Option {
+	return func(o *options) {
+		o.fileOptions = append(o.fileOptions, filestore.WithCorruptionReporter(reporter))
+	}
+}
+
+// Set the maximum key lenght in bytes
+func WithMaxKeyLenght(maxKeyLenght int) Option {
+	return func(o *options) {
+		o.fileOptions = append(o.fileOptions, filestore.WithMaxKeyLenght(maxKeyLenght))
+	}
+}
+
+// Set the maximum value lenght in bytes
+func WithMaxValueLenght(maxValueLenght int) Option {
+	return func(o *options) {
+		o.fileOptions = append(o.fileOptions, filestore.WithMaxValueLenght(maxValueLenght))
+	}
+}
+
+// Read items through memory mapping of the data files
+func WithMmap(enabled bool) Option {
+	return func(o *options) {
+		o.fileOptions = append(o.fileOptions, filestore.WithMmap(enabled))
+	}
+}
+
+// Compress values of at least threshold bytes with the codec (filestore.DeflateCodec, filestore.GzipCodec or registered codec)
+func WithCompression(codec byte, threshold int) Option {
+	return func(o *options) {
+		o.fileOptions = append(o.fileOptions, filestore.WithCompression(codec, threshold))
+	}
+}
+
+// Encrypt the data files and the mutations log with AES-GCM using keys from the provider,
+// with encryptKeys the keys are encrypted on disk too
+func WithEncryption(provider encryption.KeyProvider, encryptKeys bool) Option {
+	return func(o *options) {
+		o.keyProvider = provider
+		o.fileOptions = append(o.fileOptions, filestore.WithEncryption(provider, encryptKeys))
+	}
+}
+
+// Set when writes are synced to disk: filestore.SyncAlways, filestore.SyncInterval (every interval)
+// or filestore.SyncNever (default)
+func WithSyncPolicy(policy filestore.SyncPolicy, interval time.Duration) Option {
+	return func(o *options) {
+		o.fileOptions = append(o.fileOptions, filestore.WithSyncPolicy(policy, interval))
+	}
+}
+
+// Split every file into segments of about size bytes (default 64 MiB), 0 keeps a single segment
+func WithMaxSegmentSize(size int64) Option {
+	return func(o *options) {
+		o.fileOptions = append(o.fileOptions, filestore.WithMaxSegmentSize(size))
+	}
+}
+
+// Set when a segment needs compaction
+func WithCompactionPolicy(policy filestore.CompactionPolicy) Option {
+	return func(o *options) {
+		o.fileOptions = append(o.fileOptions, filestore.WithCompactionPolicy(policy))
+	}
+}
+
+// Set the maximum number of files compacted at the same time (default 1)
+func WithCompactionConcurrency(maxConcurrency int) Option {
+	return func(o *options) {
+		o.compactionConcurrency = maxConcurrency
+	}
+}
+
+// Limit the bytes per second written by all the running compactions (default unlimited)
+func WithCompactionRateLimit(bytesPerSecond int) Option {
+	return func(o *options) {
+		o.compactionRateLimit = bytesPerSecond
+	}
+}
+
+// Open existing files without creating or modifying anything, mutations return ErrReadOnly
+func WithReadOnly(readOnly bool) Option {
+	return func(o *options) {
+		o.readOnly = readOnly
+		o.fileOptions = append(o.fileOptions, filestore.WithReadOnly(readOnly))
+	}
+}
+
+// Set how often expired keys are deleted from the files in the background (default 1 minute), 0 disables the sweeper
+func WithExpirySweepInterval(interval time.Duration) Option {
+	return func(o *options) {
+		o.fileOptions = append(o.fileOptions, filestore.WithExpirySweepInterval(interval))
+	}
+}
@@ -0,0 +1,51 @@
+package engine
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Token bucket limiter of bytes per second, shared by all the compactions
+type rateLimiter struct {
+	lock      sync.Mutex
+	rate      float64
+	available float64
+	last      time.Time
+}
+
+func newRateLimiter(bytesPerSecond int) *rateLimiter {
+	return &rateLimiter{
+		rate:      float64(bytesPerSecond),
+		available: float64(bytesPerSecond),
+		last:      time.Now(),
+	}
+}
+
+// Take n bytes from the bucket and wait until they are available
+func (l *rateLimiter) WaitN(ctx context.Context, n int) error {
+	l.lock.Lock()
+	now := time.Now()
+	l.available += now.Sub(l.last).Seconds() * l.rate
+	if l.available > l.rate {
+		l.available = l.rate
+	}
+	l.last = now
+	l.available -= float64(n)
+	wait := time.Duration(-l.available / l.rate * float64(time.Second))
+	l.lock.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
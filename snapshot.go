@@ -0,0 +1,157 @@
+package engine
+
+import (
+	"context"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/lokidb/engine/v2/cursor"
+	filestore "github.com/lokidb/engine/v2/file_storage"
+)
+
+// Read-only view of all the files as of the time it was created. Writes wait while the snapshots
+// of the files are created so the view is consistent across files. Compaction keeps the items that
+// open snapshots read and Flush fails while snapshots are open, so snapshots must be released.
+type Snapshot struct {
+	s         *storage
+	snapshots map[string]*filestore.Snapshot // by filename
+	released  int32
+}
+
+// Create snapshot of the whole store
+func (s *storage) Snapshot() (*Snapshot, error) {
+	if s.isClosed() {
+		return nil, ErrClosed
+	}
+
+	s.batchLock.Lock()
+	defer s.batchLock.Unlock()
+
+	if err := s.recoverPendingBatch(); err != nil {
+		return nil, err
+	}
+
+	// All the files use the same creation time so keys expire at the same moment in every file
+	now := time.Now()
+	snap := &Snapshot{s: s, snapshots: make(map[string]*filestore.Snapshot, len(s.fileStores))}
+	atomic.AddInt32(&s.snapshots, 1)
+	for filename, fileStore := range s.fileStores {
+		fileSnapshot, err := fileStore.SnapshotAt(now)
+		if err != nil {
+			snap.Release()
+			return nil, err
+		}
+
+		snap.snapshots[filename] = fileSnapshot
+	}
+
+	return snap, nil
+}
+
+// Get value of key as of the snapshot creation, specify valueReader to read only specific section from the value
+func (snap *Snapshot) Get(key string, valueReader func(cursor.Cursor) ([]byte, error)) ([]byte, error) {
+	return snap.snapshots[snap.s.filesRing.GetMemberForKey(key)].Get(key, valueReader)
+}
+
+// Get value and version of key as of the snapshot creation
+func (snap *Snapshot) GetWithVersion(key string, valueReader func(cursor.Cursor) ([]byte, error)) ([]byte, uint64, error) {
+	return snap.snapshots[snap.s.filesRing.GetMemberForKey(key)].GetWithVersion(key, valueReader)
+}
+
+func (snap *Snapshot) Keys() ([]string, error) {
+	keys := make([]string, 0, 10000)
+
+	for _, fileSnapshot := range snap.snapshots {
+		fileKeys, err := fileSnapshot.Keys()
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, fileKeys...)
+	}
+
+	return keys, nil
+}
+
+// scan all the values of the snapshot and filter them with the 'evaluate' function
+func (snap *Snapshot) Search(ctx context.Context, evaluate func(value []byte) bool) ([][]byte, error) {
+	results := make([][]byte, 0, 1000)
+
+	for _, fileSnapshot := range snap.snapshots {
+		fileResults, err := fileSnapshot.Search(ctx, evaluate)
+		if err != nil {
+			return nil, err
+		}
+
+		results = append(results, fileResults...)
+	}
+
+	return results, nil
+}
+
+// Iterator over the keys of the snapshot in sorted order, values are read as the iterator moves
+func (snap *Snapshot) Iterator() (*Iterator, error) {
+	keys, err := snap.Keys()
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(keys)
+
+	return &Iterator{snap: snap, keys: keys}, nil
+}
+
+// Release the snapshots of all the files, the items that were kept for the snapshot are compacted
+// once no snapshots are open
+func (snap *Snapshot) Release() error {
+	if atomic.CompareAndSwapInt32(&snap.released, 0, 1) {
+		atomic.AddInt32(&snap.s.snapshots, -1)
+	}
+
+	var releaseErr error
+
+	for _, fileSnapshot := range snap.snapshots {
+		if err := fileSnapshot.Release(); err != nil && releaseErr == nil {
+			releaseErr = err
+		}
+	}
+
+	return releaseErr
+}
+
+// Iterator over the keys and values of a snapshot
+type Iterator struct {
+	snap     *Snapshot
+	keys     []string
+	position int
+	key      string
+	value    []byte
+	err      error
+}
+
+// Move to the next key, returns false when there are no more keys or reading the value failed
+func (it *Iterator) Next() bool {
+	if it.err != nil || it.position >= len(it.keys) {
+		return false
+	}
+
+	it.key = it.keys[it.position]
+	it.position++
+	it.value, it.err = it.snap.Get(it.key, nil)
+
+	return it.err == nil
+}
+
+func (it *Iterator) Key() string {
+	return it.key
+}
+
+func (it *Iterator) Value() []byte {
+	return it.value
+}
+
+// Error that stopped the iteration, nil when all the keys were iterated
+func (it *Iterator) Err() error {
+	return it.err
+}
@@ -0,0 +1,183 @@
+package engine
+
+import (
+	"errors"
+	"sync"
+
+	filestore "github.com/lokidb/engine/v2/file_storage"
+)
+
+// Optimistic transaction, reads record the version of the keys and writes are buffered until commit.
+// Commit writes all the buffered writes as a single batch only when none of the read keys was changed
+// since it was read, otherwise it returns ErrConflict and nothing is written.
+// Keys are read once, later reads of a key return the first read or the transaction own writes.
+// Reads don't copy the store, every key is read at its latest version when it is first read and
+// only the versions of the read keys are validated at commit, so reads never block other writes.
+type Txn struct {
+	s      *storage
+	reads  map[string]txnRead
+	writes map[string]filestore.BatchOp // latest write of every key
+	ops    []filestore.BatchOp          // writes in order
+	done   bool
+	lock   sync.Mutex
+}
+
+type txnRead struct {
+	value   []byte
+	version uint64
+	exists  bool
+}
+
+// Start optimistic transaction
+func (s *storage) Begin() (*Txn, error) {
+	if s.isClosed() {
+		return nil, ErrClosed
+	}
+
+	return &Txn{
+		s:      s,
+		reads:  make(map[string]txnRead),
+		writes: make(map[string]filestore.BatchOp),
+	}, nil
+}
+
+// Get value of key, returns ErrNotFound when the key does not exist or was deleted by the transaction
+func (t *Txn) Get(key string) ([]byte, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.done {
+		return nil, ErrTxnDone
+	}
+
+	if op, written := t.writes[key]; written {
+		if op.Delete {
+			return nil, ErrNotFound
+		}
+
+		return op.Value, nil
+	}
+
+	read, err := t.read(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if !read.exists {
+		return nil, ErrNotFound
+	}
+
+	return read.value, nil
+}
+
+// Read key from the store once and record its version
+func (t *Txn) read(key string) (txnRead, error) {
+	if read, exists := t.reads[key]; exists {
+		return read, nil
+	}
+
+	if t.s.isClosed() {
+		return txnRead{}, ErrClosed
+	}
+
+	fileStore := t.s.fileStores[t.s.filesRing.GetMemberForKey(key)]
+
+	value, version, err := fileStore.GetWithVersion(key, nil)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return txnRead{}, err
+	}
+
+	read := txnRead{value: value, version: version, exists: err == nil}
+	t.reads[key] = read
+
+	return read, nil
+}
+
+// Buffer set of key value until commit
+func (t *Txn) Set(key string, value []byte) error {
+	return t.write(filestore.BatchOp{Key: key, Value: value})
+}
+
+// Buffer delete of key until commit, deleting a key that doesn't exist is not an error
+func (t *Txn) Del(key string) error {
+	return t.write(filestore.BatchOp{Key: key, Delete: true})
+}
+
+func (t *Txn) write(op filestore.BatchOp) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.done {
+		return ErrTxnDone
+	}
+
+	t.writes[op.Key] = op
+	t.ops = append(t.ops, op)
+
+	return nil
+}
+
+// Write the buffered writes when none of the read keys was changed, returns ErrConflict otherwise.
+// The transaction is done after commit either way.
+func (t *Txn) Commit() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.done {
+		return ErrTxnDone
+	}
+	t.done = true
+
+	s := t.s
+	if s.isClosed() {
+		return ErrClosed
+	}
+
+	if len(t.ops) > 0 && s.options.readOnly {
+		return ErrReadOnly
+	}
+
+	// Other writes wait while the reads are validated and the writes are written
+	s.batchLock.Lock()
+	defer s.batchLock.Unlock()
+
+	if err := s.recoverPendingBatch(); err != nil {
+		return err
+	}
+
+	for key, read := range t.reads {
+		fileStore := s.fileStores[s.filesRing.GetMemberForKey(key)]
+
+		version, err := fileStore.Version(key)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+
+		if exists := err == nil; exists != read.exists || version != read.version {
+			return ErrConflict
+		}
+	}
+
+	if len(t.ops) == 0 {
+		return nil
+	}
+
+	return s.writeBatch(t.ops)
+}
+
+// Discard the buffered writes
+func (t *Txn) Rollback() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.done {
+		return ErrTxnDone
+	}
+	t.done = true
+
+	t.reads = nil
+	t.writes = nil
+	t.ops = nil
+
+	return nil
+}
@@ -1,31 +1,41 @@
 package engine
 
 import (
+	"encoding/base64"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"strconv"
 
-	filestore "github.com/lokidb/engine/file_storage"
+	"github.com/lokidb/engine/v2/encryption"
+	filestore "github.com/lokidb/engine/v2/file_storage"
 )
 
-func createFileStores(rootPath string, filesCount int) map[string]*filestore.FileKeyValueStore {
+func createFileStores(rootPath string, filesCount int, fileOptions []filestore.Option) (map[string]*filestore.FileKeyValueStore, error) {
 	fileStores := make(map[string]*filestore.FileKeyValueStore, filesCount)
 
 	for i := 0; i < filesCount; i++ {
 		filename := filePrefix + strconv.Itoa(i) + fileExtension
 		filePath := filepath.Join(rootPath, filename)
-		fileStore := filestore.New(filePath)
+		fileStore, err := filestore.New(filePath, fileOptions...)
+		if err != nil {
+			// Stores opened so far are closed so their handles and background work are released
+			for _, opened := range fileStores {
+				opened.Close()
+			}
+
+			return nil, err
+		}
 		fileStores[filename] = fileStore
 	}
 
-	return fileStores
+	return fileStores, nil
 }
 
-func (s *storage) appendToLog(command string, key string, value []byte) {
+func (s *storage) appendToLog(command string, key string, value []byte) error {
 	if !toggleAOL {
-		return
+		return nil
 	}
 
 	s.aolLock.Lock()
@@ -35,31 +45,25 @@ func (s *storage) appendToLog(command string, key string, value []byte) {
 	if err != nil {
 		file, err = os.Create(s.aolPath)
 		if err != nil {
-			panic(err)
+			return err
 		}
 	}
+	defer file.Close()
 
 	endOffset, _ := file.Seek(0, io.SeekEnd)
 
-	file.WriteAt([]byte(fmt.Sprintf("%s -:- %s -:- %v\n", command, key, value)), endOffset)
-}
-
-func equals(a []byte, b []byte) bool {
-	if a == nil && b == nil {
-		return true
-	} else if a == nil || b == nil {
-		return false
-	}
-
-	if len(a) != len(b) {
-		return false
-	}
+	line := []byte(fmt.Sprintf("%s -:- %s -:- %v", command, key, value))
 
-	for i := 0; i < len(a); i++ {
-		if a[i] != b[i] {
-			return false
+	// Encrypted lines are written in base64 to keep the log line based
+	if s.options.keyProvider != nil {
+		sealed, err := encryption.Seal(s.options.keyProvider, line, nil)
+		if err != nil {
+			return err
 		}
+
+		line = []byte(base64.StdEncoding.EncodeToString(sealed))
 	}
 
-	return true
+	_, err = file.WriteAt(append(line, '\n'), endOffset)
+	return err
 }